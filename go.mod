@@ -7,13 +7,15 @@ require (
 	github.com/dusted-go/logging v1.3.0
 	github.com/kevinburke/ssh_config v1.2.0
 	github.com/neovim/go-client v1.2.2-0.20240514170004-863141a115a5
+	github.com/pkg/sftp v1.13.6
 	github.com/skeema/knownhosts v1.3.0
 	github.com/urfave/cli/v3 v3.4.1
 	golang.org/x/crypto v0.28.0
 	golang.org/x/term v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,6 +1,9 @@
-local uname = vim.uv.os_uname()
+-- This also runs on nvim that's too old for nvrh, so nvrh can say so instead
+-- of failing somewhere later. Stick to what older versions have.
+local uv = vim.uv or vim.loop
+local uname = uv.os_uname()
 ---@type uv.os_get_passwd.passwd
-local passwd = vim.uv.os_get_passwd()
+local passwd = uv.os_get_passwd()
 
 local function get_os()
   local os = uname.sysname:lower()
@@ -66,13 +69,24 @@ local function get_shell_name()
   return 'unknown'
 end
 
+local function get_version()
+  local version = vim.version and vim.version() or vim.fn.api_info().version
+
+  return {
+    major = version.major,
+    minor = version.minor,
+    patch = version.patch,
+  }
+end
+
 local server_info = {
   os = get_os(),
   arch = get_arch(),
   username = passwd.username,
   homedir = passwd.homedir,
-  tmpdir = vim.uv.os_tmpdir(),
+  tmpdir = uv.os_tmpdir(),
   shell_name = get_shell_name(),
+  version = get_version(),
 }
 
 return vim.json.encode(server_info)
@@ -0,0 +1,54 @@
+local session_id = ...
+
+local is_windows = vim.fn.has('win32') == 1
+local separator = is_windows and '\\' or '/'
+local probe_path = vim.uv.os_tmpdir() .. separator .. 'nvrh-doctor-' .. session_id
+
+local result = {
+  tmpdir = vim.uv.os_tmpdir(),
+  tmpdir_writable = false,
+  script_runs = false,
+  nvim_path = vim.fn.exepath('nvim'),
+}
+
+local function write_file(path, contents)
+  local file, err = io.open(path, 'w')
+  if not file then
+    return err
+  end
+
+  file:write(contents)
+  file:close()
+end
+
+local err = write_file(probe_path, 'nvrh')
+if err then
+  result.tmpdir_error = err
+else
+  result.tmpdir_writable = true
+  os.remove(probe_path)
+end
+
+-- The bridge scripts are written to the tmpdir and executed from there, which
+-- fails on `noexec` mounts.
+local script_path = probe_path .. (is_windows and '.bat' or '.sh')
+local script = is_windows and '@echo off\r\necho nvrh-doctor\r\n'
+  or '#!/bin/sh\necho nvrh-doctor\n'
+
+err = write_file(script_path, script)
+if err then
+  result.script_error = err
+else
+  vim.fn.setfperm(script_path, 'rwxr-xr-x')
+
+  local ok, output = pcall(vim.fn.system, { script_path })
+  if ok and vim.v.shell_error == 0 and output:match('nvrh%-doctor') then
+    result.script_runs = true
+  else
+    result.script_error = vim.trim(tostring(output))
+  end
+
+  os.remove(script_path)
+end
+
+return vim.json.encode(result)
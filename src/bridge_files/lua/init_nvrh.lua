@@ -38,6 +38,14 @@ if _G._nvrh_is_initialized ~= true then
 
   vim.env.NVRH_SESSION_ID = session_id
 
+  -- sync-config points XDG_CONFIG_HOME at the uploaded config, which programs
+  -- started from nvim, like a `:terminal`, shouldn't inherit.
+  if vim.env.NVRH_XDG_CONFIG_HOME ~= nil then
+    local original = vim.env.NVRH_XDG_CONFIG_HOME
+    vim.env.XDG_CONFIG_HOME = original ~= '' and original or nil
+    vim.env.NVRH_XDG_CONFIG_HOME = nil
+  end
+
   local function cleanup()
     os.remove(browser_script_path)
     os.remove(editor_script_path)
@@ -0,0 +1,96 @@
+if _G._nvrh_is_initialized ~= true then
+  local clipboard_script_path, enable_clipboard = ...
+
+  -- Nothing is defined when the clipboard is off, so nothing on the server
+  -- can read the local clipboard through `--remote-expr`.
+  if enable_clipboard then
+    ---@return NvrhChannel?
+    local function clipboard_channel()
+      for _, channel in ipairs(_G._nvrh.get_nvrh_channels()) do
+        if channel.client.methods and channel.client.methods['clipboard-copy'] then
+          return channel
+        end
+      end
+    end
+
+    ---@param lines string[]
+    ---@param regtype string
+    function _G._nvrh.clipboard_copy(lines, regtype)
+      local channel = clipboard_channel()
+      if channel then
+        pcall(vim.rpcnotify, channel.id, 'clipboard-copy', lines, regtype)
+      end
+    end
+
+    ---@return [string[], string]|integer
+    function _G._nvrh.clipboard_paste()
+      local channel = clipboard_channel()
+      if not channel then
+        return 0
+      end
+
+      local ok, result = pcall(vim.rpcrequest, channel.id, 'clipboard-paste')
+      if not ok then
+        vim.notify('nvrh: ' .. tostring(result), vim.log.levels.ERROR)
+        return 0
+      end
+
+      return result
+    end
+
+    -- Used by the nvrh-clipboard script. Base64 survives the quoting in
+    -- `--remote-expr`.
+    ---@param encoded string
+    function _G._nvrh.clipboard_copy_base64(encoded)
+      local text = vim.base64.decode(encoded)
+      local regtype = 'v'
+      if text:sub(-1) == '\n' then
+        regtype = 'V'
+        text = text:sub(1, -2)
+      end
+
+      _G._nvrh.clipboard_copy(vim.split(text, '\n', { plain = true }), regtype)
+    end
+
+    ---@return string
+    function _G._nvrh.clipboard_paste_base64()
+      local result = _G._nvrh.clipboard_paste()
+      if type(result) ~= 'table' then
+        return ''
+      end
+
+      local text = table.concat(result[1], '\n')
+      if result[2] == 'V' then
+        text = text .. '\n'
+      end
+
+      return vim.base64.encode(text)
+    end
+
+    vim.api.nvim_create_autocmd('VimLeavePre', {
+      callback = function()
+        os.remove(clipboard_script_path)
+      end,
+    })
+
+    vim.g.clipboard = {
+      name = 'nvrh',
+      copy = {
+        ['+'] = _G._nvrh.clipboard_copy,
+        ['*'] = _G._nvrh.clipboard_copy,
+      },
+      paste = {
+        ['+'] = _G._nvrh.clipboard_paste,
+        ['*'] = _G._nvrh.clipboard_paste,
+      },
+    }
+
+    -- The provider may already be loaded with the server's clipboard.
+    vim.g.loaded_clipboard_provider = nil
+    vim.cmd('runtime autoload/provider/clipboard.vim')
+
+    if clipboard_script_path ~= '' then
+      vim.env.NVRH_CLIPBOARD = clipboard_script_path
+    end
+  end
+end
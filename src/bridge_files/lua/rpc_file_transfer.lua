@@ -0,0 +1,92 @@
+if _G._nvrh_is_initialized ~= true then
+  ---@param method string
+  ---@return NvrhChannel?
+  local function channel_with_method(method)
+    for _, channel in ipairs(_G._nvrh.get_nvrh_channels()) do
+      if channel.client.methods and channel.client.methods[method] then
+        return channel
+      end
+    end
+  end
+
+  ---@param path string
+  ---@return string
+  local function absolute_path(path)
+    local expanded = vim.fn.fnamemodify(vim.fn.expand(path), ':p')
+    if #expanded > 1 then
+      expanded = expanded:gsub('[/\\]$', '')
+    end
+
+    return expanded
+  end
+
+  ---@param remote_path string
+  ---@param local_path? string
+  function _G._nvrh.download(remote_path, local_path)
+    local channel = channel_with_method('download')
+    if not channel then
+      vim.notify('nvrh: no client to download to', vim.log.levels.ERROR)
+      return
+    end
+
+    remote_path = absolute_path(remote_path)
+    if not vim.uv.fs_stat(remote_path) then
+      vim.notify(('nvrh: %s does not exist'):format(remote_path), vim.log.levels.ERROR)
+      return
+    end
+
+    vim.rpcnotify(channel.id, 'download', { remote_path, local_path or '' })
+  end
+
+  ---@param local_path string
+  ---@param remote_path? string
+  function _G._nvrh.upload(local_path, remote_path)
+    local channel = channel_with_method('upload')
+    if not channel then
+      vim.notify('nvrh: no client to upload from', vim.log.levels.ERROR)
+      return
+    end
+
+    -- The local path may be a Windows path.
+    local name = local_path:gsub('[/\\]+$', ''):match('[^/\\]+$')
+
+    if not remote_path or remote_path == '' then
+      remote_path = vim.fn.getcwd() .. '/' .. name
+    else
+      remote_path = absolute_path(remote_path)
+      local stat = vim.uv.fs_stat(remote_path)
+      if stat and stat.type == 'directory' then
+        remote_path = remote_path .. '/' .. name
+      end
+    end
+
+    if vim.uv.fs_stat(remote_path) then
+      local choice = vim.fn.confirm(
+        ('%s exists. Overwrite it?'):format(remote_path),
+        '&Yes\n&No',
+        2
+      )
+      if choice ~= 1 then
+        return
+      end
+    end
+
+    vim.rpcnotify(channel.id, 'upload', { local_path, remote_path })
+  end
+
+  vim.api.nvim_create_user_command('NvrhDownload', function(args)
+    _G._nvrh.download(args.fargs[1], args.fargs[2])
+  end, {
+    nargs = '+',
+    complete = 'file',
+    force = true,
+  })
+
+  vim.api.nvim_create_user_command('NvrhUpload', function(args)
+    _G._nvrh.upload(args.fargs[1], args.fargs[2])
+  end, {
+    nargs = '+',
+    complete = 'file',
+    force = true,
+  })
+end
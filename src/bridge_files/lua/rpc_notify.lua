@@ -0,0 +1,82 @@
+if _G._nvrh_is_initialized ~= true then
+  local notify_script_path, forward_notifications = ...
+
+  local level_names = {
+    [vim.log.levels.WARN] = 'WARN',
+    [vim.log.levels.ERROR] = 'ERROR',
+  }
+
+  ---@param message string
+  ---@param opts? { title?: string, level?: integer|string }
+  function _G._nvrh.notify(message, opts)
+    opts = opts or {}
+
+    local level = opts.level or 'INFO'
+    if type(level) == 'number' then
+      level = level_names[level] or 'INFO'
+    end
+
+    for _, channel in ipairs(_G._nvrh.get_nvrh_channels()) do
+      if channel.client.methods['notify'] then
+        pcall(vim.rpcnotify, tonumber(channel.id), 'notify', { message, opts.title or '', level })
+      end
+    end
+  end
+
+  vim.api.nvim_create_user_command('NvrhNotify', function(args)
+    _G._nvrh.notify(args.args)
+  end, {
+    nargs = '+',
+    force = true,
+  })
+
+  vim.api.nvim_create_autocmd('VimLeavePre', {
+    callback = function()
+      os.remove(notify_script_path)
+    end,
+  })
+
+  if forward_notifications then
+    local original_notify = vim.notify
+    ---@diagnostic disable-next-line: duplicate-set-field
+    vim.notify = function(msg, level, opts)
+      if level and level >= vim.log.levels.WARN then
+        _G._nvrh.notify(msg, { title = opts and opts.title, level = level })
+      end
+
+      return original_notify(msg, level, opts)
+    end
+
+    -- Terminal programs notify with OSC 9 (`\e]9;message\a`) or OSC 777
+    -- (`\e]777;notify;title;message\a`). A plain BEL never reaches Lua, it's
+    -- rung by the local UI instead.
+    vim.api.nvim_create_autocmd('TermRequest', {
+      callback = function(ev)
+        -- Neovim 0.11 passes a table, 0.10 the sequence itself.
+        local sequence = type(ev.data) == 'table' and ev.data.sequence or ev.data
+        if type(sequence) ~= 'string' then
+          return
+        end
+
+        local title, message = sequence:match('^\027%]777;notify;([^;]*);(.*)')
+        if not message then
+          message = sequence:match('^\027%]9;(.*)')
+          -- OSC 9;4 is a progress report, not a notification.
+          if message and message:match('^4;') then
+            message = nil
+          end
+        end
+
+        if message then
+          -- Drop the terminator if it's included, BEL or ST.
+          message = message:gsub('\007$', ''):gsub('\027\\$', '')
+          _G._nvrh.notify(message, { title = title or vim.fn.getbufvar(ev.buf, 'term_title') })
+        end
+      end,
+    })
+  end
+
+  if notify_script_path ~= '' then
+    vim.env.NVRH_NOTIFY = notify_script_path
+  end
+end
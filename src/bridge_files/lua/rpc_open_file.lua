@@ -86,9 +86,11 @@ if _G._nvrh_is_initialized ~= true then
     end
   end
 
-  vim.env.NVRH_EDITOR = editor_script_path
-  vim.env.EDITOR = editor_script_path
-  vim.env.VISUAL = editor_script_path
-  vim.env.GIT_EDITOR = editor_script_path
-  vim.env.LAUNCH_EDITOR = editor_script_path
+  if editor_script_path ~= '' then
+    vim.env.NVRH_EDITOR = editor_script_path
+    vim.env.EDITOR = editor_script_path
+    vim.env.VISUAL = editor_script_path
+    vim.env.GIT_EDITOR = editor_script_path
+    vim.env.LAUNCH_EDITOR = editor_script_path
+  end
 end
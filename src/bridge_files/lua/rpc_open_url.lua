@@ -10,6 +10,37 @@ if _G._nvrh_is_initialized ~= true then
     end
   end
 
+  ---@param path string
+  function _G._nvrh.open_remote_file(path)
+    for _, channel in ipairs(_G._nvrh.get_nvrh_channels()) do
+      if channel.client.methods['open-remote-file'] then
+        pcall(vim.rpcnotify, tonumber(channel.id), 'open-remote-file', { path })
+      end
+    end
+  end
+
+  --- The absolute path of a file on the server, if `uri` is a `file://` URI
+  --- or a path to one that exists.
+  ---@param uri string
+  ---@return string?
+  local function remote_file_path(uri)
+    local path
+    if uri:match('^file://') then
+      path = vim.fs.normalize(vim.uri_to_fname(uri))
+    elseif uri:match('^%a[%w+.-]+:') then
+      -- Some other scheme. A single letter is a Windows drive.
+      return nil
+    else
+      path = vim.fs.normalize(vim.fn.fnamemodify(vim.fs.normalize(uri), ':p'))
+    end
+
+    local uv = vim.uv or vim.loop
+    local stat = uv.fs_stat(path)
+    if stat and stat.type == 'file' then
+      return path
+    end
+  end
+
   vim.api.nvim_create_user_command('NvrhOpenUrl', function(args)
     _G._nvrh.open_url(args.args)
   end, {
@@ -20,14 +51,29 @@ if _G._nvrh_is_initialized ~= true then
   local original_open = vim.ui.open
   ---@diagnostic disable-next-line: duplicate-set-field
   vim.ui.open = function(uri, opts)
-    if type(uri) == 'string' and uri:match('^https?://') then
+    if type(uri) ~= 'string' then
+      return original_open(uri, opts)
+    end
+
+    local path = remote_file_path(uri)
+    if path then
+      _G._nvrh.open_remote_file(path)
+      return nil, nil
+    end
+
+    -- Any other scheme goes to the client, whose policy decides what's
+    -- allowed.
+    if uri:match('^%a[%w+.-]+:') and not uri:match('^file:') then
       _G._nvrh.open_url(uri)
       return nil, nil
-    else
-      return original_open(uri, opts)
     end
+
+    return original_open(uri, opts)
   end
 
-  vim.env.NVRH_BROWSER = browser_script_path
-  vim.env.BROWSER = browser_script_path
+  -- There's no script when nothing may listen on the server.
+  if browser_script_path ~= '' then
+    vim.env.NVRH_BROWSER = browser_script_path
+    vim.env.BROWSER = browser_script_path
+  end
 end
@@ -0,0 +1,56 @@
+-- Relays stdin / stdout to a unix socket or `host:port`, for transports that
+-- only give us a process to talk to, like `docker exec`.
+local address = ...
+
+local stdin = vim.uv.new_pipe()
+local stdout = vim.uv.new_pipe()
+stdin:open(0)
+stdout:open(1)
+
+local function quit()
+  vim.schedule(function()
+    vim.cmd('qall!')
+  end)
+end
+
+---@type uv.uv_stream_t
+local remote
+
+local function on_connect(err)
+  if err then
+    io.stderr:write('nvrh relay: ' .. err .. '\n')
+    quit()
+    return
+  end
+
+  remote:read_start(function(read_err, data)
+    if read_err or not data then
+      stdout:shutdown(quit)
+      return
+    end
+
+    stdout:write(data)
+  end)
+
+  stdin:read_start(function(read_err, data)
+    if read_err or not data then
+      remote:shutdown(quit)
+      return
+    end
+
+    remote:write(data)
+  end)
+end
+
+local host, port = address:match('^(.*):(%d+)$')
+if host then
+  if host == 'localhost' then
+    host = '127.0.0.1'
+  end
+
+  remote = vim.uv.new_tcp()
+  remote:connect(host, tonumber(port), on_connect)
+else
+  remote = vim.uv.new_pipe()
+  remote:connect(address, on_connect)
+end
@@ -0,0 +1,78 @@
+found=
+via=
+
+try_path() {
+  case "$1" in
+    "~/"*) set -- "$HOME/${1#"~/"}" "$2" ;;
+  esac
+
+  case "$1" in
+    */*)
+      if [ ! -x "$1" ] || [ -d "$1" ]; then
+        return 1
+      fi
+      found=$1
+      ;;
+    *)
+      found=$(command -v "$1" 2>/dev/null)
+      if [ -z "$found" ]; then
+        return 1
+      fi
+      ;;
+  esac
+
+  via=$2
+}
+
+discover() {
+{{range .Candidates}}  try_path {{.}} "candidate" && return
+{{end}}{{if .Cached}}  try_path {{.Cached}} "cache" && return
+{{end}}  try_path nvim "PATH" && return
+
+  # Version managers and package managers often only add themselves to the
+  # PATH of login or interactive shells.
+  if [ -n "$SHELL" ] && [ -x "$SHELL" ]; then
+    try_path "$("$SHELL" -l -c "command -v nvim" </dev/null 2>/dev/null | tail -n 1)" "login shell" && return
+    try_path "$("$SHELL" -i -c "command -v nvim" </dev/null 2>/dev/null | tail -n 1)" "interactive shell" && return
+  fi
+
+  for candidate in \
+    "$HOME/.local/bin/nvim" \
+    "$HOME/bin/nvim" \
+    "$HOME/.local/share/mise/shims/nvim" \
+    "$HOME/.asdf/shims/nvim" \
+    "$HOME/.local/share/bob/nvim-bin/nvim" \
+    "$HOME/.nix-profile/bin/nvim" \
+    "/nix/var/nix/profiles/default/bin/nvim" \
+    "/run/current-system/sw/bin/nvim" \
+    "/home/linuxbrew/.linuxbrew/bin/nvim" \
+    "$HOME/.linuxbrew/bin/nvim" \
+    "/opt/homebrew/bin/nvim" \
+    "/usr/local/bin/nvim" \
+    "/opt/nvim/bin/nvim" \
+    "/opt/nvim-linux-x86_64/bin/nvim" \
+    "/opt/nvim-linux-arm64/bin/nvim" \
+    "/opt/nvim-linux64/bin/nvim" \
+    "/snap/bin/nvim"; do
+    try_path "$candidate" "well-known location" && return
+  done
+
+  found=
+}
+
+{{if .Discover}}discover
+echo "found=$found"
+echo "via=$via"
+{{end}}
+cache_dir="${XDG_CACHE_HOME:-$HOME/.cache}/nvrh/nvim-"{{.Version}}
+echo "os=$(uname -s)"
+echo "arch=$(uname -m)"
+echo "cache_dir=$cache_dir"
+if [ -x "$cache_dir/bin/nvim" ]; then
+  echo "cached=yes"
+fi
+if [ -n "$found" ]; then
+  echo "nvim_version=$("$found" --version 2>/dev/null | head -n 1)"
+else
+  echo "nvim_version=$({{.NvimCmd}} --version 2>/dev/null | head -n 1)"
+fi
@@ -0,0 +1,15 @@
+@echo off
+
+:: nvrh-clipboard copy < file
+:: nvrh-clipboard paste > file
+
+set "SOCKET_PATH={{.SocketPath}}"
+
+if "%~1"=="copy" (
+  powershell -NoProfile -Command "$text = [Console]::In.ReadToEnd(); $encoded = [Convert]::ToBase64String([Text.Encoding]::UTF8.GetBytes($text)); nvim --server $env:SOCKET_PATH --remote-expr ('v:lua._G._nvrh.clipboard_copy_base64(''' + $encoded + ''')') | Out-Null"
+) else if "%~1"=="paste" (
+  powershell -NoProfile -Command "$encoded = nvim --server $env:SOCKET_PATH --remote-expr 'v:lua._G._nvrh.clipboard_paste_base64()'; [Console]::Out.Write([Text.Encoding]::UTF8.GetString([Convert]::FromBase64String($encoded)))"
+) else (
+  echo Usage: %~nx0 copy^|paste 1>&2
+  exit /b 1
+)
@@ -0,0 +1,18 @@
+@echo off
+
+:: nvrh-notify <message> [title]
+
+set "MESSAGE=%~1"
+set "TITLE=%~2"
+
+:: Escape backslashes
+set "MESSAGE=%MESSAGE:\=\\%"
+if defined TITLE set "TITLE=%TITLE:\=\\%"
+
+:: Escape double quotes
+set "MESSAGE=%MESSAGE:"=\"%"
+if defined TITLE set "TITLE=%TITLE:"=\"%"
+
+set "SOCKET_PATH={{.SocketPath}}"
+
+nvim --server "%SOCKET_PATH%" --remote-expr "v:lua._G._nvrh.notify(\"%MESSAGE%\", {'title': \"%TITLE%\"})" > nul 2>&1
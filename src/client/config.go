@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+
+	"nvrh/src/nvrh_config"
+	"nvrh/src/ssh_endpoint"
+)
+
+var CliConfigCommand = cli.Command{
+	Name:  "config",
+	Usage: "Inspect the config file",
+
+	Commands: []*cli.Command{
+		&CliConfigPathCommand,
+		&CliConfigShowCommand,
+		&CliConfigValidateCommand,
+	},
+}
+
+var CliConfigPathCommand = cli.Command{
+	Name:  "path",
+	Usage: "Print the path of the config file",
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		path := nvrh_config.ConfigPath(cmd.String("config"))
+		fmt.Println(path)
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, "The file doesn't exist, so only defaults and environment variables apply.")
+		}
+
+		return nil
+	},
+}
+
+var CliConfigShowCommand = cli.Command{
+	Name:  "show",
+	Usage: "Print the value of every option and where it comes from",
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "server",
+			Usage: "Server to show the options for. Defaults to only showing the default section",
+		},
+
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		cfg, err := nvrh_config.Load(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+
+		host := ""
+		if server := cmd.String("server"); server != "" {
+			endpoint, err := ssh_endpoint.ParseSshEndpoint(server)
+			if err != nil {
+				return err
+			}
+			host = endpoint.ConfigKey()
+		}
+
+		effective, err := cfg.Explain(ClientFlags(), host, cmd.String("profile"))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Config file: %s\n\n", nvrh_config.ConfigPath(cmd.String("config")))
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "OPTION\tVALUE\tSOURCE")
+		for _, e := range effective {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", e.Name, e.Value, e.Source)
+		}
+
+		return writer.Flush()
+	},
+}
+
+var CliConfigValidateCommand = cli.Command{
+	Name:  "validate",
+	Usage: "Check the config file for unknown options, wrong types and broken extends",
+
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+	},
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		path := nvrh_config.ConfigPath(cmd.String("config"))
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+
+		cfg, err := nvrh_config.Load(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid config file %s:\n  %s", path, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+		}
+
+		fmt.Printf("%s is valid\n", path)
+
+		return nil
+	},
+}
+
+// flagOnlyNames are flags that can't be set in the config file: the ones
+// picking what to read from it, and force, which shouldn't be turned on for
+// every cp.
+var flagOnlyNames = []string{"config", "profile", "help", "force"}
+
+// ClientFlags returns the flags of every command that reads the config file,
+// once each.
+func ClientFlags() []cli.Flag {
+	flags := []cli.Flag{}
+	seen := []string{}
+
+	for _, command := range []*cli.Command{
+		&CliClientOpenCommand,
+		&CliClientReconnectCommand,
+		&CliClientFromNeovimCommand,
+		&CliClientCpCommand,
+		&CliDoctorCommand,
+	} {
+		for _, flag := range command.Flags {
+			name := flag.Names()[0]
+			if slices.Contains(seen, name) || slices.Contains(flagOnlyNames, name) {
+				continue
+			}
+
+			seen = append(seen, name)
+			flags = append(flags, flag)
+		}
+	}
+
+	return flags
+}
@@ -0,0 +1,490 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	"nvrh/src/bridge_files"
+	nvrh_context "nvrh/src/context"
+	"nvrh/src/logger"
+	"nvrh/src/nvim_bootstrap"
+	"nvrh/src/nvim_helpers"
+	"nvrh/src/nvrh_base_ssh"
+	"nvrh/src/nvrh_config"
+	"nvrh/src/ssh_endpoint"
+	"nvrh/src/ssh_tunnel_info"
+)
+
+const doctorStepTimeout = 20 * time.Second
+
+var CliDoctorCommand = cli.Command{
+	Name:      "doctor",
+	Usage:     "Check each step of connecting to a server and report what fails",
+	ArgsUsage: "<server>",
+
+	Flags: slices.Concat([]cli.Flag{
+		&cli.BoolFlag{
+			Name:    "debug",
+			Usage:   "",
+			Sources: cli.EnvVars("NVRH_CLIENT_DEBUG"),
+		},
+
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "local-editor",
+			Usage: "Local editor to use. {{SOCKET_PATH}} will be replaced with the socket path [$NVRH_CLIENT_LOCAL_EDITOR]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_LOCAL_EDITOR"),
+			Value: []string{"nvim", "--server", "{{SOCKET_PATH}}", "--remote-ui"},
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "nvim-cmd",
+			Usage: "Command to run nvim with. Defaults to `nvim` [$NVRH_CLIENT_NVIM_CMD]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_NVIM_CMD"),
+			Value: []string{"nvim"},
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "nvim-candidate",
+			Usage: "Paths to try, in order, when looking for nvim on the server. Only used when --nvim-cmd isn't set [$NVRH_CLIENT_NVIM_CANDIDATE]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_NVIM_CANDIDATE"),
+		},
+	}, transportFlags()),
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		cfg, err := nvrh_config.Load(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+
+		server := cmd.Args().Get(0)
+		if server == "" {
+			return fmt.Errorf("<server> is required")
+		}
+
+		report := &doctorReport{}
+		sessionId := fmt.Sprintf("doctor-%d", time.Now().Unix())
+
+		endpoint, parseErr := ssh_endpoint.ParseSshEndpoint(server)
+		if parseErr == nil {
+			defaultConfig, serverConfig, err := cfg.Resolve(endpoint.ConfigKey(), cmd.String("profile"))
+			if err != nil {
+				return err
+			}
+			if err := nvrh_config.ApplyPrecedence(cmd, defaultConfig, serverConfig); err != nil {
+				return err
+			}
+		}
+
+		isDebug := cmd.Bool("debug")
+		logger.PrepareLogger(isDebug)
+
+		// Endpoint resolution
+		if !report.check(
+			"Resolve endpoint",
+			"Check the server is written as [user@]host[:port], docker://[user@]container or k8s://<namespace>/<pod>[/<container>], and that your SSH config parses with `ssh -G <host>`.",
+			func() (string, error) {
+				if parseErr != nil {
+					return "", parseErr
+				}
+
+				if endpoint.Scheme != ssh_endpoint.SchemeSsh {
+					return endpoint.String(), nil
+				}
+
+				endpoint.ResolveSshConfig(cmd.String("ssh-path"))
+
+				return fmt.Sprintf(
+					"%s (user from %s, host from %s, port from %s)",
+					endpoint, endpoint.UserSource(), endpoint.HostSource(), endpoint.PortSource(),
+				), nil
+			},
+		) {
+			return report.finish()
+		}
+
+		nvrhContext := &nvrh_context.NvrhContext{
+			SessionId: sessionId,
+			Endpoint:  endpoint,
+
+			ForwardAgent: optionalBool(cmd, "forward-agent"),
+
+			Proxy: cmd.String("proxy"),
+
+			Debug: isDebug,
+
+			TunneledPorts: make(map[string]string),
+
+			NvimCmd: cmd.StringSlice("nvim-cmd"),
+		}
+
+		defer func() {
+			killAllCmds(nvrhContext.CommandsToKill)
+			if nvrhContext.SshClient != nil {
+				nvrhContext.SshClient.Close()
+			}
+		}()
+
+		// Authentication for the chosen transport
+		transport := endpoint.Scheme
+		if transport == ssh_endpoint.SchemeSsh {
+			transport = cmd.String("ssh-path")
+		}
+
+		connected := report.check(
+			fmt.Sprintf("Connect with %s", transport),
+			"Try connecting with the same transport by hand. For 'binary', nvrh can't answer password prompts when it isn't attached to a terminal; use a key or an agent. For 'internal', run with --debug to see which keys are offered.",
+			func() (string, error) {
+				sshClient, err := getSshClient(nvrhContext, endpoint, cmd)
+				if err != nil {
+					return "", err
+				}
+				nvrhContext.SshClient = sshClient
+
+				output, err := runCaptured(sshClient, "echo nvrh-doctor")
+				if err != nil {
+					return "", err
+				}
+
+				if !strings.Contains(output, "nvrh-doctor") {
+					return "", fmt.Errorf("unexpected output: %q", strings.TrimSpace(output))
+				}
+
+				return "ran a command on the server", nil
+			},
+		)
+
+		if !connected {
+			report.skip("Find nvim", "not connected")
+			report.skip("Start nvim", "not connected")
+			report.skip("Detect remote shell", "not connected")
+			report.skip("Write to tmpdir", "not connected")
+			report.skip("Run bridge scripts", "not connected")
+			report.skip("Listen and tunnel over a port", "not connected")
+			report.skip("Listen and tunnel over a unix socket", "not connected")
+		} else {
+			nvimCmd := strings.Join(nvrhContext.NvimCmd, " ")
+
+			report.check(
+				"Find nvim",
+				"nvrh runs nvim from a non-interactive shell, which may not have the same PATH as your login shell. Set nvim-cmd to the full path in your config, or add it to nvim-candidate.",
+				func() (string, error) {
+					foundVia := ""
+					if !cmd.IsSet("nvim-cmd") {
+						probe, err := nvim_bootstrap.RunProbe(
+							nvrhContext.SshClient,
+							endpoint.String(),
+							nvrhContext.NvimCmd,
+							cmd.StringSlice("nvim-candidate"),
+							true,
+							// Only names the bootstrap cache dir, which isn't
+							// checked here.
+							"",
+						)
+						// Discovery needs `sh`, so it is skipped on Windows.
+						if err == nil && probe.Discovery != nil {
+							discovery := probe.Discovery
+							nvrhContext.NvimCmd = discovery.NvimCmd(nvrhContext.NvimCmd)
+							nvimCmd = strings.Join(nvrhContext.NvimCmd, " ")
+							foundVia = fmt.Sprintf(", found at %s via %s", discovery.Path, discovery.Via)
+						}
+					}
+
+					output, err := runCaptured(nvrhContext.SshClient, fmt.Sprintf("%s --version", nvimCmd))
+					if err != nil {
+						return "", err
+					}
+
+					firstLine, _, _ := strings.Cut(strings.TrimSpace(output), "\n")
+					if firstLine == "" {
+						return "", fmt.Errorf("%s --version printed nothing, it's probably not installed or not on the PATH", nvimCmd)
+					}
+
+					if !strings.HasPrefix(firstLine, "NVIM") {
+						return "", fmt.Errorf("%s --version printed %q", nvimCmd, firstLine)
+					}
+
+					return strings.TrimSpace(firstLine) + foundVia, nil
+				},
+			)
+
+			var serverInfo *nvrh_context.NvrhServerInfo
+			var checks doctorRemoteChecks
+
+			started := report.check(
+				"Start nvim",
+				"Run the nvim command on the server by hand to see its errors.",
+				func() (string, error) {
+					stream, err := nvrhContext.SshClient.RunStdio(fmt.Sprintf("%s -u NONE --embed --headless", nvimCmd))
+					if err != nil {
+						return "", err
+					}
+
+					nv, err := nvim_helpers.NvimFromStream(stream)
+					if err != nil {
+						stream.Close()
+						return "", err
+					}
+
+					defer nv.Close()
+
+					return withTimeout(func() (string, error) {
+						var serverInfoString string
+						if err := nv.ExecLua(bridge_files.ReadFileWithoutError("lua/determine_server_info.lua"), &serverInfoString, nil); err != nil {
+							return "", err
+						}
+
+						if err := json.Unmarshal([]byte(serverInfoString), &serverInfo); err != nil {
+							return "", err
+						}
+
+						if err := checkRemoteNvimVersion(serverInfo.Version); err != nil {
+							return "", err
+						}
+
+						var checksString string
+						if err := nv.ExecLua(bridge_files.ReadFileWithoutError("lua/doctor_checks.lua"), &checksString, sessionId); err != nil {
+							return "", err
+						}
+
+						if err := json.Unmarshal([]byte(checksString), &checks); err != nil {
+							return "", err
+						}
+
+						nv.ExecLua("vim.cmd('qall!')", nil, nil)
+
+						return fmt.Sprintf("nvim %s on %s/%s as %s", serverInfo.Version, serverInfo.Os, serverInfo.Arch, serverInfo.Username), nil
+					})
+				},
+			)
+
+			if !started {
+				report.skip("Detect remote shell", "nvim didn't start")
+				report.skip("Write to tmpdir", "nvim didn't start")
+				report.skip("Run bridge scripts", "nvim didn't start")
+			} else {
+				report.check(
+					"Detect remote shell",
+					"nvrh detects bash, zsh, powershell and cmd from $SHELL or your login shell. Others are started like bash, which may not work.",
+					func() (string, error) {
+						if serverInfo.ShellName == "unknown" {
+							return "", fmt.Errorf("unknown shell")
+						}
+
+						return serverInfo.ShellName, nil
+					},
+				)
+
+				report.check(
+					"Write to tmpdir",
+					"nvrh writes its socket and bridge scripts to the tmpdir. Make it writable, or point $TMPDIR somewhere that is.",
+					func() (string, error) {
+						if !checks.TmpdirWritable {
+							return "", fmt.Errorf("%s: %s", checks.Tmpdir, checks.TmpdirError)
+						}
+
+						return checks.Tmpdir, nil
+					},
+				)
+
+				report.check(
+					"Run bridge scripts",
+					"$EDITOR and $BROWSER are scripts in the tmpdir that call `nvim`. The tmpdir must not be mounted noexec, and nvim must be on the PATH.",
+					func() (string, error) {
+						if !checks.ScriptRuns {
+							return "", fmt.Errorf("script in %s didn't run: %s", checks.Tmpdir, checks.ScriptError)
+						}
+
+						if checks.NvimPath == "" {
+							return "", fmt.Errorf("nvim isn't on the PATH the scripts run with")
+						}
+
+						return fmt.Sprintf("scripts run and find %s", checks.NvimPath), nil
+					},
+				)
+			}
+
+			randomPort := getRandomPort()
+			report.check(
+				"Listen and tunnel over a port",
+				"nvim couldn't listen on a port, or the port couldn't be tunneled. Check AllowTcpForwarding on the server, or try --use-stdio.",
+				func() (string, error) {
+					return checkListenAndTunnel(ctx, nvrhContext, nvimCmd, &ssh_tunnel_info.SshTunnelInfo{
+						Mode:         "port",
+						LocalSocket:  fmt.Sprintf("%d", randomPort),
+						RemoteSocket: fmt.Sprintf("%d", randomPort),
+					})
+				},
+			)
+
+			if serverInfo != nil && serverInfo.Os == "windows" {
+				report.skip("Listen and tunnel over a unix socket", "Windows servers use ports")
+			} else {
+				report.check(
+					"Listen and tunnel over a unix socket",
+					"nvim couldn't listen on a socket in /tmp, or the socket couldn't be tunneled. Check AllowStreamLocalForwarding on the server, or use --use-ports or --use-stdio.",
+					func() (string, error) {
+						return checkListenAndTunnel(ctx, nvrhContext, nvimCmd, &ssh_tunnel_info.SshTunnelInfo{
+							Mode:         "unix",
+							LocalSocket:  filepath.Join(os.TempDir(), fmt.Sprintf("nvrh-socket-%s", sessionId)),
+							RemoteSocket: fmt.Sprintf("/tmp/nvrh-socket-%s", sessionId),
+						})
+					},
+				)
+			}
+		}
+
+		localEditor := cmd.StringSlice("local-editor")
+		report.check(
+			"Find local editor",
+			"Install it, or set local-editor to a command that exists on this machine.",
+			func() (string, error) {
+				if len(localEditor) == 0 {
+					return "", fmt.Errorf("local-editor is empty")
+				}
+
+				return exec.LookPath(localEditor[0])
+			},
+		)
+
+		return report.finish()
+	},
+}
+
+type doctorRemoteChecks struct {
+	Tmpdir         string `json:"tmpdir"`
+	TmpdirWritable bool   `json:"tmpdir_writable"`
+	TmpdirError    string `json:"tmpdir_error"`
+	ScriptRuns     bool   `json:"script_runs"`
+	ScriptError    string `json:"script_error"`
+	NvimPath       string `json:"nvim_path"`
+}
+
+type doctorReport struct {
+	failed int
+}
+
+// check runs a step and prints whether it passed, with the hint when it
+// didn't.
+func (r *doctorReport) check(name string, hint string, step func() (string, error)) bool {
+	detail, err := step()
+	if err != nil {
+		r.failed++
+		fmt.Printf("✗ %s: %v\n    hint: %s\n", name, err, hint)
+		return false
+	}
+
+	fmt.Printf("✓ %s: %s\n", name, detail)
+	return true
+}
+
+func (r *doctorReport) skip(name string, reason string) {
+	fmt.Printf("- %s: skipped, %s\n", name, reason)
+}
+
+func (r *doctorReport) finish() error {
+	if r.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", r.failed)
+	}
+
+	return nil
+}
+
+// runCaptured runs a command on the server and returns its output.
+func runCaptured(sshClient nvrh_base_ssh.BaseNvrhSshClient, command string) (string, error) {
+	stream, err := sshClient.RunStdio(command)
+	if err != nil {
+		return "", err
+	}
+
+	defer stream.Close()
+
+	return withTimeout(func() (string, error) {
+		output, err := io.ReadAll(stream)
+		return string(output), err
+	})
+}
+
+func withTimeout(step func() (string, error)) (string, error) {
+	type result struct {
+		detail string
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		detail, err := step()
+		done <- result{detail, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.detail, r.err
+	case <-time.After(doctorStepTimeout):
+		return "", fmt.Errorf("timed out after %s", doctorStepTimeout)
+	}
+}
+
+// checkListenAndTunnel starts nvim listening on the remote side of the
+// tunnel and connects to it from the local side.
+func checkListenAndTunnel(
+	ctx context.Context,
+	nvrhContext *nvrh_context.NvrhContext,
+	nvimCmd string,
+	ti *ssh_tunnel_info.SshTunnelInfo,
+) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- nvrhContext.SshClient.Run(
+			fmt.Sprintf("%s -u NONE --headless --listen \"%s\"", nvimCmd, ti.RemoteBoundToIp()),
+			ti,
+		)
+		// Stop waiting once nvim is gone.
+		cancel()
+	}()
+
+	if ti.Mode == "unix" {
+		defer os.Remove(ti.LocalSocket)
+	}
+
+	nv, err := nvim_helpers.WaitForNvim(ctx, ti)
+	if err != nil {
+		select {
+		case err := <-runErr:
+			if err != nil {
+				return "", fmt.Errorf("nvim exited: %w", err)
+			}
+		default:
+		}
+
+		return "", err
+	}
+
+	closeNvimSocket(nv, true)
+
+	return fmt.Sprintf("%s -> %s", ti.LocalBoundToIp(), ti.RemoteBoundToIp()), nil
+}
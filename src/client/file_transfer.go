@@ -0,0 +1,405 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+
+	nvrh_context "nvrh/src/context"
+	"nvrh/src/file_transfer"
+	"nvrh/src/go_ssh_ext"
+	"nvrh/src/local_dialog"
+	"nvrh/src/logger"
+	"nvrh/src/nvrh_config"
+	"nvrh/src/ssh_endpoint"
+)
+
+var CliClientCpCommand = cli.Command{
+	Name:      "cp",
+	Usage:     "Copy files and directories to or from a server",
+	Category:  "client",
+	ArgsUsage: "<source> <destination>",
+	Description: "One of <source> / <destination> is on the server, written as <server>:<path>, " +
+		"like docker://my-container:/workspace/notes.md. Paths on the server are relative to the " +
+		"home directory. A destination ending in a slash, or an existing local directory, " +
+		"receives the source inside it.",
+
+	Flags: slices.Concat([]cli.Flag{
+		&cli.BoolFlag{
+			Name:    "debug",
+			Usage:   "",
+			Sources: cli.EnvVars("NVRH_CLIENT_DEBUG"),
+		},
+
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "Overwrite the destination without asking",
+		},
+	}, transportFlags()),
+
+	Action: func(ctx context.Context, cmd *cli.Command) error {
+		cfg, err := nvrh_config.Load(cmd.String("config"))
+		if err != nil {
+			return err
+		}
+
+		source := cmd.Args().Get(0)
+		destination := cmd.Args().Get(1)
+		if source == "" || destination == "" {
+			return fmt.Errorf("<source> and <destination> are required")
+		}
+
+		sourceServer, sourcePath, sourceIsRemote := splitRemoteArg(source)
+		destinationServer, destinationPath, destinationIsRemote := splitRemoteArg(destination)
+
+		if sourceIsRemote == destinationIsRemote {
+			return fmt.Errorf("exactly one of <source> / <destination> must be on a server, like <server>:<path>")
+		}
+
+		server := sourceServer
+		if destinationIsRemote {
+			server = destinationServer
+		}
+
+		endpoint, err := ssh_endpoint.ParseSshEndpoint(server)
+		if err != nil {
+			return err
+		}
+
+		defaultConfig, serverConfig, err := cfg.Resolve(endpoint.ConfigKey(), cmd.String("profile"))
+		if err != nil {
+			return err
+		}
+		if err := nvrh_config.ApplyPrecedence(cmd, defaultConfig, serverConfig); err != nil {
+			return err
+		}
+
+		isDebug := cmd.Bool("debug")
+		logger.PrepareLogger(isDebug)
+
+		endpoint.ResolveSshConfig(cmd.String("ssh-path"))
+
+		nvrhContext := &nvrh_context.NvrhContext{
+			SessionId: fmt.Sprintf("cp-%d", time.Now().Unix()),
+			Endpoint:  endpoint,
+
+			ForwardAgent: optionalBool(cmd, "forward-agent"),
+
+			Proxy: cmd.String("proxy"),
+
+			Debug: isDebug,
+
+			TunneledPorts: make(map[string]string),
+		}
+
+		sshClient, err := getSshClient(nvrhContext, endpoint, cmd)
+		if err != nil {
+			return err
+		}
+		nvrhContext.SshClient = sshClient
+
+		defer func() {
+			killAllCmds(nvrhContext.CommandsToKill)
+			sshClient.Close()
+		}()
+
+		transfer := file_transfer.New(sshClient)
+		defer transfer.Close()
+
+		progress := printProgress(filepath.Base(sourcePath))
+
+		if destinationIsRemote {
+			localPath, err := file_transfer.ExpandLocalPath(sourcePath)
+			if err != nil {
+				return err
+			}
+
+			if _, err := os.Stat(localPath); err != nil {
+				return err
+			}
+
+			remotePath := destinationPath
+			if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+				remotePath += filepath.Base(localPath)
+			}
+
+			exists, err := transfer.RemoteExists(remotePath)
+			if err != nil {
+				return err
+			}
+
+			if exists && !confirmOverwrite(cmd, fmt.Sprintf("%s:%s", server, remotePath)) {
+				return fmt.Errorf("not overwriting %s", remotePath)
+			}
+
+			return finishProgress(progress, transfer.Upload(localPath, remotePath, progress))
+		}
+
+		localPath, err := file_transfer.ExpandLocalPath(destinationPath)
+		if err != nil {
+			return err
+		}
+
+		if info, err := os.Stat(localPath); (err == nil && info.IsDir()) || strings.HasSuffix(destinationPath, "/") {
+			localPath = filepath.Join(localPath, path.Base(sourcePath))
+		}
+
+		if _, err := os.Stat(localPath); err == nil && !confirmOverwrite(cmd, localPath) {
+			return fmt.Errorf("not overwriting %s", localPath)
+		}
+
+		return finishProgress(progress, transfer.Download(sourcePath, localPath, progress))
+	},
+}
+
+// splitRemoteArg splits `<server>:<path>` like scp does. Anything without a
+// colon before the first slash, and Windows drive letters, are local paths.
+func splitRemoteArg(arg string) (string, string, bool) {
+	schemeEnd := 0
+	for _, scheme := range []string{ssh_endpoint.SchemeDocker, ssh_endpoint.SchemeK8s, ssh_endpoint.SchemeSsh} {
+		if strings.HasPrefix(arg, scheme+"://") {
+			schemeEnd = len(scheme) + len("://")
+			break
+		}
+	}
+
+	if schemeEnd == 0 && len(arg) >= 2 && arg[1] == ':' && ((arg[0] >= 'a' && arg[0] <= 'z') || (arg[0] >= 'A' && arg[0] <= 'Z')) {
+		return "", arg, false
+	}
+
+	colon := strings.Index(arg[schemeEnd:], ":")
+	if colon == -1 {
+		return "", arg, false
+	}
+	colon += schemeEnd
+
+	server := arg[:colon]
+	// k8s://<namespace>/<pod> has slashes of its own.
+	if schemeEnd == 0 && strings.ContainsAny(server, `/\`) {
+		return "", arg, false
+	}
+
+	return server, arg[colon+1:], true
+}
+
+func confirmOverwrite(cmd *cli.Command, target string) bool {
+	if cmd.Bool("force") {
+		return true
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+
+	answer, err := go_ssh_ext.AskForInput(fmt.Sprintf("%s exists. Overwrite it? (yes/no) ", target))
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(string(answer), "yes") || strings.EqualFold(string(answer), "y")
+}
+
+func printProgress(name string) file_transfer.Progress {
+	if !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+
+	return func(done int64, total int64) {
+		fmt.Fprintf(os.Stderr, "\r\033[K%s", formatProgress(name, done, total))
+	}
+}
+
+// finishProgress ends the progress line, so what comes after starts on a
+// line of its own.
+func finishProgress(progress file_transfer.Progress, err error) error {
+	if progress != nil {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	return err
+}
+
+func formatProgress(name string, done int64, total int64) string {
+	if total <= 0 {
+		return fmt.Sprintf("%s: %s", name, file_transfer.FormatBytes(done))
+	}
+
+	return fmt.Sprintf(
+		"%s: %s / %s (%d%%)",
+		name,
+		file_transfer.FormatBytes(done),
+		file_transfer.FormatBytes(total),
+		done*100/total,
+	)
+}
+
+// remoteBase is path.Base for paths from a server that may be running
+// Windows.
+func remoteBase(remotePath string) string {
+	trimmed := strings.TrimRight(remotePath, `/\`)
+	if i := strings.LastIndexAny(trimmed, `/\`); i != -1 {
+		return trimmed[i+1:]
+	}
+
+	return trimmed
+}
+
+func notifyRemote(v *nvim.Nvim, message string, level string) {
+	if err := v.ExecLua("vim.notify(..., vim.log.levels[select(2, ...)])", nil, message, level); err != nil {
+		slog.Warn("Failed to notify remote nvim", "err", err)
+	}
+}
+
+func echoRemote(v *nvim.Nvim, message string) {
+	v.ExecLua("vim.api.nvim_echo({ { ... } }, false, {})", nil, message)
+}
+
+// confirmLocally asks with a dialog on this machine, since a prompt in the
+// remote nvim could be answered by the server itself.
+func confirmLocally(v *nvim.Nvim, message string, button string) bool {
+	ok, err := local_dialog.Confirm("nvrh", message, button)
+	if err != nil {
+		slog.Error("Failed to ask for confirmation", "err", err)
+		notifyRemote(v, fmt.Sprintf("nvrh: couldn't ask for confirmation on your machine: %s", err), "ERROR")
+		return false
+	}
+
+	return ok
+}
+
+// isWithinDir reports whether target is inside dir.
+func isWithinDir(dir string, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// RpcHandleDownload copies a file or directory from the server to this
+// machine. The remote nvim passes an absolute path, and an optional local
+// path. Anything but a new file in the download folder is confirmed on this
+// machine first.
+func RpcHandleDownload(nvrhContext *nvrh_context.NvrhContext) func(v *nvim.Nvim, args []string) {
+	return func(v *nvim.Nvim, args []string) {
+		remotePath := args[0]
+		name := remoteBase(remotePath)
+
+		localPath := filepath.Join(file_transfer.DefaultDownloadDir(), name)
+		if len(args) > 1 && args[1] != "" {
+			expanded, err := file_transfer.ExpandLocalPath(args[1])
+			if err != nil {
+				notifyRemote(v, fmt.Sprintf("nvrh: %s", err), "ERROR")
+				return
+			}
+			localPath = expanded
+
+			if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+				localPath = filepath.Join(localPath, name)
+			}
+		}
+
+		// Don't block other RPC handlers while copying.
+		go func() {
+			// New files in the download folder are fine, anything else could
+			// be a way for the server to plant files on this machine.
+			_, err := os.Stat(localPath)
+			exists := err == nil
+			if exists || !isWithinDir(file_transfer.DefaultDownloadDir(), localPath) {
+				message := fmt.Sprintf("%s wants to download %s to:\n\n%s", nvrhContext.Endpoint.Given, remotePath, localPath)
+				if exists {
+					message += "\n\nIt already exists and will be overwritten."
+				}
+
+				if !confirmLocally(v, message, "Download") {
+					notifyRemote(v, "nvrh: download cancelled", "WARN")
+					return
+				}
+			}
+
+			transfer := file_transfer.New(nvrhContext.SshClient)
+			defer transfer.Close()
+
+			slog.Info("Downloading", "remotePath", remotePath, "localPath", localPath)
+
+			err = transfer.Download(remotePath, localPath, func(done int64, total int64) {
+				echoRemote(v, "nvrh: downloading "+formatProgress(name, done, total))
+			})
+			if err != nil {
+				slog.Error("Download failed", "err", err)
+				notifyRemote(v, fmt.Sprintf("nvrh: downloading %s failed: %s", name, err), "ERROR")
+				return
+			}
+
+			notifyRemote(v, fmt.Sprintf("nvrh: downloaded %s to %s", name, localPath), "INFO")
+		}()
+	}
+}
+
+// RpcHandleUpload copies a file or directory from this machine to the
+// server. The remote nvim has already confirmed overwriting the remote path,
+// but reading a local file is always confirmed on this machine.
+func RpcHandleUpload(nvrhContext *nvrh_context.NvrhContext) func(v *nvim.Nvim, args []string) {
+	return func(v *nvim.Nvim, args []string) {
+		localPath, err := file_transfer.ExpandLocalPath(args[0])
+		if err != nil {
+			notifyRemote(v, fmt.Sprintf("nvrh: %s", err), "ERROR")
+			return
+		}
+		remotePath := args[1]
+		name := filepath.Base(localPath)
+
+		if _, err := os.Stat(localPath); err != nil {
+			notifyRemote(v, fmt.Sprintf("nvrh: %s", err), "ERROR")
+			return
+		}
+
+		go func() {
+			message := fmt.Sprintf("%s wants to upload from your machine:\n\n%s\n\nto %s on the server.", nvrhContext.Endpoint.Given, localPath, remotePath)
+			if !confirmLocally(v, message, "Upload") {
+				notifyRemote(v, "nvrh: upload cancelled", "WARN")
+				return
+			}
+
+			transfer := file_transfer.New(nvrhContext.SshClient)
+			defer transfer.Close()
+
+			slog.Info("Uploading", "localPath", localPath, "remotePath", remotePath)
+
+			err := transfer.Upload(localPath, remotePath, func(done int64, total int64) {
+				echoRemote(v, "nvrh: uploading "+formatProgress(name, done, total))
+			})
+			if err != nil {
+				slog.Error("Upload failed", "err", err)
+				notifyRemote(v, fmt.Sprintf("nvrh: uploading %s failed: %s", name, err), "ERROR")
+				return
+			}
+
+			notifyRemote(v, fmt.Sprintf("nvrh: uploaded %s to %s", name, remotePath), "INFO")
+		}()
+	}
+}
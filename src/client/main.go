@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -20,17 +23,26 @@ import (
 	"github.com/urfave/cli/v3"
 
 	"nvrh/src/bridge_files"
+	"nvrh/src/config_sync"
 	nvrh_context "nvrh/src/context"
 	"nvrh/src/exec_helpers"
 	"nvrh/src/go_ssh_ext"
+	"nvrh/src/local_clipboard"
+	"nvrh/src/local_notify"
 	"nvrh/src/logger"
+	"nvrh/src/nvim_bootstrap"
 	"nvrh/src/nvim_helpers"
 	"nvrh/src/nvrh_base_ssh"
 	"nvrh/src/nvrh_binary_ssh"
 	"nvrh/src/nvrh_config"
+	"nvrh/src/nvrh_docker_ssh"
 	"nvrh/src/nvrh_internal_ssh"
+	"nvrh/src/nvrh_k8s_ssh"
+	"nvrh/src/nvrh_local_ssh"
+	"nvrh/src/rpc_mux"
 	"nvrh/src/ssh_endpoint"
 	"nvrh/src/ssh_tunnel_info"
+	"nvrh/src/url_policy"
 )
 
 func defaultSshPath() string {
@@ -48,6 +60,7 @@ var CliClientCommand = cli.Command{
 		&CliClientOpenCommand,
 		&CliClientReconnectCommand,
 		&CliClientFromNeovimCommand,
+		&CliClientCpCommand,
 	},
 }
 
@@ -57,14 +70,7 @@ var CliClientOpenCommand = cli.Command{
 	Category:  "client",
 	ArgsUsage: "<server> [remote-directory]",
 
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:  "ssh-path",
-			Usage: "Path to SSH binary. 'binary' will use the default system SSH binary. 'internal' will use the internal SSH client. Anything else will be used as the path to the SSH binary [$NVRH_CLIENT_SSH_PATH]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_PATH"),
-			Value: "binary",
-		},
-
+	Flags: slices.Concat([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "use-ports",
 			Usage: "Use ports instead of sockets. Defaults to true on Windows [$NVRH_CLIENT_USE_PORTS]",
@@ -78,6 +84,18 @@ var CliClientOpenCommand = cli.Command{
 			Sources: cli.EnvVars("NVRH_CLIENT_DEBUG"),
 		},
 
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+
 		&cli.StringSliceFlag{
 			Name:  "server-env",
 			Usage: "Environment variables to set on the remote server [$NVRH_CLIENT_SERVER_ENV]",
@@ -91,6 +109,37 @@ var CliClientOpenCommand = cli.Command{
 			Value: []string{"nvim", "--server", "{{SOCKET_PATH}}", "--remote-ui"},
 		},
 
+		&cli.StringSliceFlag{
+			Name:  "open-url-cmd",
+			Usage: "Command to open URLs with. {{URL}} will be replaced with the URL. Defaults to the system handler [$NVRH_CLIENT_OPEN_URL_CMD]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CMD"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-scheme",
+			Usage: "URL schemes the server may open locally, like mailto [$NVRH_CLIENT_OPEN_URL_SCHEME]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_SCHEME"),
+			Value: url_policy.DefaultSchemes,
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-allow-host",
+			Usage: "Hosts the server may open URLs for, like *.github.com. Defaults to any host [$NVRH_CLIENT_OPEN_URL_ALLOW_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_ALLOW_HOST"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-deny-host",
+			Usage: "Hosts the server may not open URLs for, even if allowed [$NVRH_CLIENT_OPEN_URL_DENY_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_DENY_HOST"),
+		},
+
+		&cli.BoolFlag{
+			Name:  "open-url-confirm",
+			Usage: "Ask on this machine before opening URLs or files from the server [$NVRH_CLIENT_OPEN_URL_CONFIRM]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CONFIRM"),
+		},
+
 		&cli.StringSliceFlag{
 			Name:  "nvim-cmd",
 			Usage: "Command to run nvim with. Defaults to `nvim` [$NVRH_CLIENT_NVIM_CMD]",
@@ -99,9 +148,9 @@ var CliClientOpenCommand = cli.Command{
 		},
 
 		&cli.StringSliceFlag{
-			Name:  "ssh-arg",
-			Usage: "Additional arguments to pass to the SSH command [$NVRH_CLIENT_SSH_ARG]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_ARG"),
+			Name:  "nvim-candidate",
+			Usage: "Paths to try, in order, when looking for nvim on the server. Only used when --nvim-cmd isn't set [$NVRH_CLIENT_NVIM_CANDIDATE]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_NVIM_CANDIDATE"),
 		},
 
 		&cli.BoolFlag{
@@ -111,6 +160,19 @@ var CliClientOpenCommand = cli.Command{
 			Value:   true,
 		},
 
+		&cli.BoolFlag{
+			Name:    "enable-clipboard",
+			Usage:   "Use the local clipboard for the + and * registers in the remote nvim",
+			Sources: cli.EnvVars("NVRH_CLIENT_CLIPBOARD"),
+			Value:   true,
+		},
+
+		&cli.BoolFlag{
+			Name:    "forward-notifications",
+			Usage:   "Show vim.notify warnings and errors, and terminal notifications, on the desktop",
+			Sources: cli.EnvVars("NVRH_CLIENT_FORWARD_NOTIFICATIONS"),
+		},
+
 		&cli.StringFlag{
 			Name:  "insecure-direct-connect",
 			Usage: "Opens a public port on the server and connects directly to it. Use 'true' to connect to the server you're already passing",
@@ -121,17 +183,47 @@ var CliClientOpenCommand = cli.Command{
 			Usage: "Whether to use --embed instead of --headless",
 			// Sources: cli.EnvVars("NVRH_CLIENT_USE_NVIM_EMBED"),
 		},
-	},
+
+		&cli.BoolFlag{
+			Name:  "use-stdio",
+			Usage: "Talk to the remote nvim over the stdio of the SSH session instead of a socket, so nothing listens on the server [$NVRH_CLIENT_USE_STDIO]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_USE_STDIO"),
+		},
+
+		&cli.StringFlag{
+			Name:  "bootstrap-nvim",
+			Usage: "Install nvim on the server when it is missing or too old: ask, always or never [$NVRH_CLIENT_BOOTSTRAP_NVIM]",
+			Value: nvim_bootstrap.ModeAsk,
+			// Sources: cli.EnvVars("NVRH_CLIENT_BOOTSTRAP_NVIM"),
+		},
+
+		&cli.StringFlag{
+			Name:  "bootstrap-nvim-version",
+			Usage: "nvim release to install with --bootstrap-nvim [$NVRH_CLIENT_BOOTSTRAP_NVIM_VERSION]",
+			Value: "v0.11.0",
+			// Sources: cli.EnvVars("NVRH_CLIENT_BOOTSTRAP_NVIM_VERSION"),
+		},
+
+		&cli.StringFlag{
+			Name:  "sync-config",
+			Usage: "Local nvim config directory, like ~/.config/nvim, to upload to the server and use there [$NVRH_CLIENT_SYNC_CONFIG]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_SYNC_CONFIG"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "sync-config-ignore",
+			Usage: "Patterns of files to leave out of --sync-config [$NVRH_CLIENT_SYNC_CONFIG_IGNORE]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_SYNC_CONFIG_IGNORE"),
+			Value: config_sync.DefaultIgnore,
+		},
+	}, transportFlags()),
 
 	Action: func(ctx context.Context, cmd *cli.Command) error {
-		cfg, err := nvrh_config.LoadConfig(nvrh_config.DefaultConfigPath())
+		cfg, err := nvrh_config.Load(cmd.String("config"))
 		if err != nil {
 			return err
 		}
 
-		isDebug := cmd.Bool("debug")
-		logger.PrepareLogger(isDebug)
-
 		server := cmd.Args().Get(0)
 		if server == "" {
 			return fmt.Errorf("<server> is required")
@@ -142,19 +234,32 @@ var CliClientOpenCommand = cli.Command{
 			return endpointErr
 		}
 
-		serverConfig := cfg.Servers[endpoint.GivenHost]
-		if err := nvrh_config.ApplyPrecedence(cmd, cfg.Default, serverConfig); err != nil {
+		defaultConfig, serverConfig, err := cfg.Resolve(endpoint.ConfigKey(), cmd.String("profile"))
+		if err != nil {
+			return err
+		}
+		if err := nvrh_config.ApplyPrecedence(cmd, defaultConfig, serverConfig); err != nil {
 			return err
 		}
 
+		// After the config file, which can turn on debug too.
+		isDebug := cmd.Bool("debug")
+		logger.PrepareLogger(isDebug)
+
+		endpoint.ResolveSshConfig(cmd.String("ssh-path"))
+
 		sessionId := fmt.Sprintf("%d", time.Now().Unix())
-		sshPath := getSshPath(cmd.String("ssh-path"))
 
 		directConnectHost := cmd.String("insecure-direct-connect")
 		if directConnectHost == "true" {
 			directConnectHost = endpoint.FinalHost()
 		}
 
+		useStdio := cmd.Bool("use-stdio")
+		if useStdio && directConnectHost != "" {
+			return fmt.Errorf("--use-stdio can't be used with --insecure-direct-connect")
+		}
+
 		// Context with cancellation on SIGINT
 		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 		defer stop()
@@ -166,11 +271,19 @@ var CliClientOpenCommand = cli.Command{
 			Endpoint:        endpoint,
 			RemoteDirectory: cmd.Args().Get(1),
 
-			AutomapPorts: cmd.Bool("enable-automap-ports"),
+			AutomapPorts:         cmd.Bool("enable-automap-ports"),
+			Clipboard:            cmd.Bool("enable-clipboard"),
+			ForwardNotifications: cmd.Bool("forward-notifications"),
+			OpenUrlCmd:           cmd.StringSlice("open-url-cmd"),
+			UrlPolicy:            urlPolicyFromFlags(cmd),
+
+			ForwardAgent: optionalBool(cmd, "forward-agent"),
+
+			Proxy: cmd.String("proxy"),
 
 			Debug: isDebug,
 
-			TunneledPorts: make(map[string]bool),
+			TunneledPorts: make(map[string]string),
 
 			NvimCmd: cmd.StringSlice("nvim-cmd"),
 
@@ -179,7 +292,6 @@ var CliClientOpenCommand = cli.Command{
 
 		remoteEnv := cmd.StringSlice("server-env")
 		localEditor := cmd.StringSlice("local-editor")
-		sshArgs := cmd.StringSlice("ssh-arg")
 
 		shouldUsePorts := cmd.Bool("use-ports")
 		if directConnectHost != "" {
@@ -195,12 +307,34 @@ var CliClientOpenCommand = cli.Command{
 		var tunnelInfo *ssh_tunnel_info.SshTunnelInfo
 
 		// Setup SSH client
-		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, sshPath, sshArgs)
+		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, cmd)
 		if sshClientErr != nil {
 			return sshClientErr
 		}
 		nvrhContext.SshClient = sshClient
 
+		preparedNvimCmd, err := nvim_bootstrap.PrepareNvimCmd(
+			sshClient,
+			endpoint.String(),
+			nvrhContext.NvimCmd,
+			cmd.StringSlice("nvim-candidate"),
+			!cmd.IsSet("nvim-cmd"),
+			cmd.String("bootstrap-nvim"),
+			cmd.String("bootstrap-nvim-version"),
+		)
+		if err != nil {
+			return err
+		}
+		nvrhContext.NvimCmd = preparedNvimCmd
+
+		if syncConfig := cmd.String("sync-config"); syncConfig != "" {
+			syncEnv, err := config_sync.Sync(sshClient, syncConfig, cmd.StringSlice("sync-config-ignore"))
+			if err != nil {
+				return err
+			}
+			remoteEnv = append(remoteEnv, syncEnv...)
+		}
+
 		var nv *nvim.Nvim
 		didClientFail := false
 
@@ -210,6 +344,7 @@ var CliClientOpenCommand = cli.Command{
 			closeNvimSocket(nv, didClientFail)
 			killAllCmds(nvrhContext.CommandsToKill)
 			os.Remove(localSocketPath)
+			removeOpenedFiles(nvrhContext)
 			if nvrhContext.SshClient != nil {
 				nvrhContext.SshClient.Close()
 			}
@@ -227,21 +362,35 @@ var CliClientOpenCommand = cli.Command{
 
 		// Start server info nvim instance.
 		slog.Info("Starting server info nvim instance")
-		go func() {
-			// Not quoting here because Powershell doesn't like it without the
-			// preceding ampersand, and we don't know what shell we're using at this
-			// point.
-			nvimCmd := strings.Join(nvrhContext.NvimCmd, " ")
-
-			siDone <- nvrhContext.SshClient.Run(
-				fmt.Sprintf("%s -u NONE --headless --listen \"%s\"", nvimCmd, siTunnelInfo.RemoteBoundToIp()),
-				siTunnelInfo,
-			)
-		}()
+		// Not quoting here because Powershell doesn't like it without the
+		// preceding ampersand, and we don't know what shell we're using at this
+		// point.
+		siNvimCmd := strings.Join(nvrhContext.NvimCmd, " ")
+		connectServerInfo := func() (*nvim.Nvim, error) {
+			return nvim_helpers.WaitForNvim(ctx, siTunnelInfo)
+		}
+
+		if useStdio {
+			connectServerInfo = func() (*nvim.Nvim, error) {
+				stream, err := nvrhContext.SshClient.RunStdio(fmt.Sprintf("%s -u NONE --embed --headless", siNvimCmd))
+				if err != nil {
+					return nil, err
+				}
+
+				return nvim_helpers.NvimFromStream(stream)
+			}
+		} else {
+			go func() {
+				siDone <- nvrhContext.SshClient.Run(
+					fmt.Sprintf("%s -u NONE --headless --listen \"%s\"", siNvimCmd, siTunnelInfo.RemoteBoundToIp()),
+					siTunnelInfo,
+				)
+			}()
+		}
 
 		// Grab server info and potentially prepare Windows.
 		go func() {
-			siNv, err := nvim_helpers.WaitForNvim(ctx, siTunnelInfo)
+			siNv, err := connectServerInfo()
 
 			if err != nil {
 				siDone <- err
@@ -250,11 +399,26 @@ var CliClientOpenCommand = cli.Command{
 
 			var serverInfoString string
 			var serverInfo *nvrh_context.NvrhServerInfo
-			siNv.ExecLua(bridge_files.ReadFileWithoutError("lua/determine_server_info.lua"), &serverInfoString, nil)
-			json.Unmarshal([]byte(serverInfoString), &serverInfo)
+			if err := siNv.ExecLua(bridge_files.ReadFileWithoutError("lua/determine_server_info.lua"), &serverInfoString, nil); err != nil {
+				siNv.Close()
+				siDone <- fmt.Errorf("failed to get server info: %w", err)
+				return
+			}
+			if err := json.Unmarshal([]byte(serverInfoString), &serverInfo); err != nil {
+				siNv.Close()
+				siDone <- fmt.Errorf("failed to parse server info: %w", err)
+				return
+			}
 
 			nvrhContext.ServerInfo = serverInfo
 
+			if err := checkRemoteNvimVersion(serverInfo.Version); err != nil {
+				siNv.ExecLua("vim.cmd('qall!')", nil, nil)
+				siNv.Close()
+				siDone <- err
+				return
+			}
+
 			if nvrhContext.ServerInfo.Os == "windows" {
 				shouldUsePorts = true
 
@@ -270,6 +434,7 @@ var CliClientOpenCommand = cli.Command{
 					LocalSocket:       fmt.Sprintf("%d", localPortNumber),
 					RemoteSocket:      fmt.Sprintf("%d", remotePortNumber),
 					Public:            false,
+					Stdio:             useStdio,
 				}
 
 				nvimCmd := nvim_helpers.BuildRemoteCommandString(
@@ -311,6 +476,12 @@ var CliClientOpenCommand = cli.Command{
 			}
 		}
 
+		localNvimVersion, err := nvim_helpers.LocalNvimVersion(localEditor)
+		if err != nil {
+			slog.Debug("Could not get local nvim version", "err", err)
+		}
+		warnOnNvimVersionMismatch(localNvimVersion, nvrhContext.ServerInfo.Version)
+
 		// Even though this happens in the Windows Server path, we still need a
 		// check here in case that path isn't hit.
 		if tunnelInfo == nil {
@@ -320,6 +491,7 @@ var CliClientOpenCommand = cli.Command{
 				LocalSocket:       localSocketPath,
 				RemoteSocket:      remoteSocketPath,
 				Public:            false,
+				Stdio:             useStdio,
 			}
 		}
 
@@ -348,7 +520,11 @@ var CliClientOpenCommand = cli.Command{
 			}
 
 			slog.Info("Starting remote nvim", "nvimCommandString", nvimCommandString)
-			done <- nvrhContext.SshClient.Run(nvimCommandString, tunnelInfo)
+			if tunnelInfo.Stdio {
+				done <- serveNvimOverStdio(nvrhContext, nvimCommandString, tunnelInfo)
+			} else {
+				done <- nvrhContext.SshClient.Run(nvimCommandString, tunnelInfo)
+			}
 			// Call stop so WaitForNvim can exit.
 			stop()
 		}()
@@ -404,14 +580,7 @@ var CliClientFromNeovimCommand = cli.Command{
 	Category:  "client",
 	ArgsUsage: "<original-server> <server> [remote-directory]",
 
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:  "ssh-path",
-			Usage: "Path to SSH binary. 'binary' will use the default system SSH binary. 'internal' will use the internal SSH client. Anything else will be used as the path to the SSH binary [$NVRH_CLIENT_SSH_PATH]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_PATH"),
-			Value: "binary",
-		},
-
+	Flags: slices.Concat([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "use-ports",
 			Usage: "Use ports instead of sockets. Defaults to true on Windows [$NVRH_CLIENT_USE_PORTS]",
@@ -425,6 +594,18 @@ var CliClientFromNeovimCommand = cli.Command{
 			Sources: cli.EnvVars("NVRH_CLIENT_DEBUG"),
 		},
 
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+
 		&cli.StringSliceFlag{
 			Name:  "server-env",
 			Usage: "Environment variables to set on the remote server [$NVRH_CLIENT_SERVER_ENV]",
@@ -438,9 +619,9 @@ var CliClientFromNeovimCommand = cli.Command{
 		},
 
 		&cli.StringSliceFlag{
-			Name:  "ssh-arg",
-			Usage: "Additional arguments to pass to the SSH command [$NVRH_CLIENT_SSH_ARG]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_ARG"),
+			Name:  "nvim-candidate",
+			Usage: "Paths to try, in order, when looking for nvim on the server. Only used when --nvim-cmd isn't set [$NVRH_CLIENT_NVIM_CANDIDATE]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_NVIM_CANDIDATE"),
 		},
 
 		&cli.BoolFlag{
@@ -450,6 +631,50 @@ var CliClientFromNeovimCommand = cli.Command{
 			Value:   true,
 		},
 
+		&cli.BoolFlag{
+			Name:    "enable-clipboard",
+			Usage:   "Use the local clipboard for the + and * registers in the remote nvim",
+			Sources: cli.EnvVars("NVRH_CLIENT_CLIPBOARD"),
+			Value:   true,
+		},
+
+		&cli.BoolFlag{
+			Name:    "forward-notifications",
+			Usage:   "Show vim.notify warnings and errors, and terminal notifications, on the desktop",
+			Sources: cli.EnvVars("NVRH_CLIENT_FORWARD_NOTIFICATIONS"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-cmd",
+			Usage: "Command to open URLs with. {{URL}} will be replaced with the URL. Defaults to the system handler [$NVRH_CLIENT_OPEN_URL_CMD]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CMD"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-scheme",
+			Usage: "URL schemes the server may open locally, like mailto [$NVRH_CLIENT_OPEN_URL_SCHEME]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_SCHEME"),
+			Value: url_policy.DefaultSchemes,
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-allow-host",
+			Usage: "Hosts the server may open URLs for, like *.github.com. Defaults to any host [$NVRH_CLIENT_OPEN_URL_ALLOW_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_ALLOW_HOST"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-deny-host",
+			Usage: "Hosts the server may not open URLs for, even if allowed [$NVRH_CLIENT_OPEN_URL_DENY_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_DENY_HOST"),
+		},
+
+		&cli.BoolFlag{
+			Name:  "open-url-confirm",
+			Usage: "Ask on this machine before opening URLs or files from the server [$NVRH_CLIENT_OPEN_URL_CONFIRM]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CONFIRM"),
+		},
+
 		&cli.StringFlag{
 			Name:  "insecure-direct-connect",
 			Usage: "Opens a public port on the server and connects directly to it. Use 'true' to connect to the server you're already passing",
@@ -460,17 +685,47 @@ var CliClientFromNeovimCommand = cli.Command{
 			Usage: "Whether to use --embed instead of --headless",
 			// Sources: cli.EnvVars("NVRH_CLIENT_USE_NVIM_EMBED"),
 		},
-	},
+
+		&cli.BoolFlag{
+			Name:  "use-stdio",
+			Usage: "Talk to the remote nvim over the stdio of the SSH session instead of a socket, so nothing listens on the server [$NVRH_CLIENT_USE_STDIO]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_USE_STDIO"),
+		},
+
+		&cli.StringFlag{
+			Name:  "bootstrap-nvim",
+			Usage: "Install nvim on the server when it is missing or too old: ask, always or never [$NVRH_CLIENT_BOOTSTRAP_NVIM]",
+			Value: nvim_bootstrap.ModeAsk,
+			// Sources: cli.EnvVars("NVRH_CLIENT_BOOTSTRAP_NVIM"),
+		},
+
+		&cli.StringFlag{
+			Name:  "bootstrap-nvim-version",
+			Usage: "nvim release to install with --bootstrap-nvim [$NVRH_CLIENT_BOOTSTRAP_NVIM_VERSION]",
+			Value: "v0.11.0",
+			// Sources: cli.EnvVars("NVRH_CLIENT_BOOTSTRAP_NVIM_VERSION"),
+		},
+
+		&cli.StringFlag{
+			Name:  "sync-config",
+			Usage: "Local nvim config directory, like ~/.config/nvim, to upload to the server and use there [$NVRH_CLIENT_SYNC_CONFIG]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_SYNC_CONFIG"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "sync-config-ignore",
+			Usage: "Patterns of files to leave out of --sync-config [$NVRH_CLIENT_SYNC_CONFIG_IGNORE]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_SYNC_CONFIG_IGNORE"),
+			Value: config_sync.DefaultIgnore,
+		},
+	}, transportFlags()),
 
 	Action: func(ctx context.Context, cmd *cli.Command) error {
-		cfg, err := nvrh_config.LoadConfig(nvrh_config.DefaultConfigPath())
+		cfg, err := nvrh_config.Load(cmd.String("config"))
 		if err != nil {
 			return err
 		}
 
-		isDebug := cmd.Bool("debug")
-		logger.PrepareLogger(isDebug)
-
 		originalServer := cmd.Args().Get(0)
 		if originalServer == "" {
 			return fmt.Errorf("<original-server> is required")
@@ -486,19 +741,31 @@ var CliClientFromNeovimCommand = cli.Command{
 			return endpointErr
 		}
 
-		serverConfig := cfg.Servers[endpoint.GivenHost]
-		if err := nvrh_config.ApplyPrecedence(cmd, cfg.Default, serverConfig); err != nil {
+		defaultConfig, serverConfig, err := cfg.Resolve(endpoint.ConfigKey(), cmd.String("profile"))
+		if err != nil {
+			return err
+		}
+		if err := nvrh_config.ApplyPrecedence(cmd, defaultConfig, serverConfig); err != nil {
 			return err
 		}
 
+		isDebug := cmd.Bool("debug")
+		logger.PrepareLogger(isDebug)
+
+		endpoint.ResolveSshConfig(cmd.String("ssh-path"))
+
 		sessionId := fmt.Sprintf("%d", time.Now().Unix())
-		sshPath := getSshPath(cmd.String("ssh-path"))
 
 		directConnectHost := cmd.String("insecure-direct-connect")
 		if directConnectHost == "true" {
 			directConnectHost = endpoint.FinalHost()
 		}
 
+		useStdio := cmd.Bool("use-stdio")
+		if useStdio && directConnectHost != "" {
+			return fmt.Errorf("--use-stdio can't be used with --insecure-direct-connect")
+		}
+
 		// Context with cancellation on SIGINT
 		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
 		defer stop()
@@ -510,11 +777,19 @@ var CliClientFromNeovimCommand = cli.Command{
 			Endpoint:        endpoint,
 			RemoteDirectory: cmd.Args().Get(2),
 
-			AutomapPorts: cmd.Bool("enable-automap-ports"),
+			AutomapPorts:         cmd.Bool("enable-automap-ports"),
+			Clipboard:            cmd.Bool("enable-clipboard"),
+			ForwardNotifications: cmd.Bool("forward-notifications"),
+			OpenUrlCmd:           cmd.StringSlice("open-url-cmd"),
+			UrlPolicy:            urlPolicyFromFlags(cmd),
+
+			ForwardAgent: optionalBool(cmd, "forward-agent"),
+
+			Proxy: cmd.String("proxy"),
 
 			Debug: isDebug,
 
-			TunneledPorts: make(map[string]bool),
+			TunneledPorts: make(map[string]string),
 
 			NvimCmd: cmd.StringSlice("nvim-cmd"),
 
@@ -522,7 +797,6 @@ var CliClientFromNeovimCommand = cli.Command{
 		}
 
 		remoteEnv := cmd.StringSlice("server-env")
-		sshArgs := cmd.StringSlice("ssh-arg")
 
 		shouldUsePorts := cmd.Bool("use-ports")
 		if directConnectHost != "" {
@@ -538,12 +812,34 @@ var CliClientFromNeovimCommand = cli.Command{
 		var tunnelInfo *ssh_tunnel_info.SshTunnelInfo
 
 		// Setup SSH client
-		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, sshPath, sshArgs)
+		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, cmd)
 		if sshClientErr != nil {
 			return sshClientErr
 		}
 		nvrhContext.SshClient = sshClient
 
+		preparedNvimCmd, err := nvim_bootstrap.PrepareNvimCmd(
+			sshClient,
+			endpoint.String(),
+			nvrhContext.NvimCmd,
+			cmd.StringSlice("nvim-candidate"),
+			!cmd.IsSet("nvim-cmd"),
+			cmd.String("bootstrap-nvim"),
+			cmd.String("bootstrap-nvim-version"),
+		)
+		if err != nil {
+			return err
+		}
+		nvrhContext.NvimCmd = preparedNvimCmd
+
+		if syncConfig := cmd.String("sync-config"); syncConfig != "" {
+			syncEnv, err := config_sync.Sync(sshClient, syncConfig, cmd.StringSlice("sync-config-ignore"))
+			if err != nil {
+				return err
+			}
+			remoteEnv = append(remoteEnv, syncEnv...)
+		}
+
 		var nv *nvim.Nvim
 		var originalNvim *nvim.Nvim
 
@@ -553,6 +849,7 @@ var CliClientFromNeovimCommand = cli.Command{
 			closeNvimSocket(nv, false)
 			killAllCmds(nvrhContext.CommandsToKill)
 			os.Remove(localSocketPath)
+			removeOpenedFiles(nvrhContext)
 			if nvrhContext.SshClient != nil {
 				nvrhContext.SshClient.Close()
 			}
@@ -570,21 +867,35 @@ var CliClientFromNeovimCommand = cli.Command{
 
 		// Start server info nvim instance.
 		slog.Info("Starting server info nvim instance")
-		go func() {
-			// Not quoting here because Powershell doesn't like it without the
-			// preceding ampersand, and we don't know what shell we're using at this
-			// point.
-			nvimCmd := strings.Join(nvrhContext.NvimCmd, " ")
-
-			siDone <- nvrhContext.SshClient.Run(
-				fmt.Sprintf("%s -u NONE --headless --listen \"%s\"", nvimCmd, siTunnelInfo.RemoteBoundToIp()),
-				siTunnelInfo,
-			)
-		}()
+		// Not quoting here because Powershell doesn't like it without the
+		// preceding ampersand, and we don't know what shell we're using at this
+		// point.
+		siNvimCmd := strings.Join(nvrhContext.NvimCmd, " ")
+		connectServerInfo := func() (*nvim.Nvim, error) {
+			return nvim_helpers.WaitForNvim(ctx, siTunnelInfo)
+		}
+
+		if useStdio {
+			connectServerInfo = func() (*nvim.Nvim, error) {
+				stream, err := nvrhContext.SshClient.RunStdio(fmt.Sprintf("%s -u NONE --embed --headless", siNvimCmd))
+				if err != nil {
+					return nil, err
+				}
+
+				return nvim_helpers.NvimFromStream(stream)
+			}
+		} else {
+			go func() {
+				siDone <- nvrhContext.SshClient.Run(
+					fmt.Sprintf("%s -u NONE --headless --listen \"%s\"", siNvimCmd, siTunnelInfo.RemoteBoundToIp()),
+					siTunnelInfo,
+				)
+			}()
+		}
 
 		// Grab server info and potentially prepare Windows.
 		go func() {
-			siNv, err := nvim_helpers.WaitForNvim(ctx, siTunnelInfo)
+			siNv, err := connectServerInfo()
 
 			if err != nil {
 				siDone <- err
@@ -593,11 +904,26 @@ var CliClientFromNeovimCommand = cli.Command{
 
 			var serverInfoString string
 			var serverInfo *nvrh_context.NvrhServerInfo
-			siNv.ExecLua(bridge_files.ReadFileWithoutError("lua/determine_server_info.lua"), &serverInfoString, nil)
-			json.Unmarshal([]byte(serverInfoString), &serverInfo)
+			if err := siNv.ExecLua(bridge_files.ReadFileWithoutError("lua/determine_server_info.lua"), &serverInfoString, nil); err != nil {
+				siNv.Close()
+				siDone <- fmt.Errorf("failed to get server info: %w", err)
+				return
+			}
+			if err := json.Unmarshal([]byte(serverInfoString), &serverInfo); err != nil {
+				siNv.Close()
+				siDone <- fmt.Errorf("failed to parse server info: %w", err)
+				return
+			}
 
 			nvrhContext.ServerInfo = serverInfo
 
+			if err := checkRemoteNvimVersion(serverInfo.Version); err != nil {
+				siNv.ExecLua("vim.cmd('qall!')", nil, nil)
+				siNv.Close()
+				siDone <- err
+				return
+			}
+
 			if nvrhContext.ServerInfo.Os == "windows" {
 				shouldUsePorts = true
 
@@ -613,6 +939,7 @@ var CliClientFromNeovimCommand = cli.Command{
 					LocalSocket:       fmt.Sprintf("%d", localPortNumber),
 					RemoteSocket:      fmt.Sprintf("%d", remotePortNumber),
 					Public:            false,
+					Stdio:             useStdio,
 				}
 
 				nvimCmd := nvim_helpers.BuildRemoteCommandString(
@@ -663,6 +990,7 @@ var CliClientFromNeovimCommand = cli.Command{
 				LocalSocket:       localSocketPath,
 				RemoteSocket:      remoteSocketPath,
 				Public:            false,
+				Stdio:             useStdio,
 			}
 		}
 
@@ -692,7 +1020,11 @@ var CliClientFromNeovimCommand = cli.Command{
 			}
 
 			slog.Info("Starting remote nvim", "nvimCommandString", nvimCommandString)
-			done <- nvrhContext.SshClient.Run(nvimCommandString, tunnelInfo)
+			if tunnelInfo.Stdio {
+				done <- serveNvimOverStdio(nvrhContext, nvimCommandString, tunnelInfo)
+			} else {
+				done <- nvrhContext.SshClient.Run(nvimCommandString, tunnelInfo)
+			}
 			// Call stop so WaitForNvim can exit.
 			stop()
 		}()
@@ -714,6 +1046,12 @@ var CliClientFromNeovimCommand = cli.Command{
 			return fmt.Errorf("failed to connect to original nvim server %s: %w", originalServer, err)
 		}
 
+		var localNvimVersionString string
+		if err := originalNvim.ExecLua("local v = vim.version() return string.format('%d.%d.%d', v.major, v.minor, v.patch)", &localNvimVersionString, nil); err == nil {
+			localNvimVersion, _ := nvim_helpers.ParseNvimVersion(localNvimVersionString)
+			warnOnNvimVersionMismatch(localNvimVersion, nvrhContext.ServerInfo.Version)
+		}
+
 		connectAddr := tunnelInfo.LocalBoundToIp()
 		if err := originalNvim.Command(fmt.Sprintf("connect %s", connectAddr)); err != nil {
 			return fmt.Errorf("failed to send connect command: %w", err)
@@ -741,14 +1079,7 @@ var CliClientReconnectCommand = cli.Command{
 	Category:  "client",
 	ArgsUsage: "<server> <session-id>",
 
-	Flags: []cli.Flag{
-		&cli.StringFlag{
-			Name:  "ssh-path",
-			Usage: "Path to SSH binary. 'binary' will use the default system SSH binary. 'internal' will use the internal SSH client. Anything else will be used as the path to the SSH binary [$NVRH_CLIENT_SSH_PATH]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_PATH"),
-			Value: "binary",
-		},
-
+	Flags: slices.Concat([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "use-ports",
 			Usage: "Use ports instead of sockets. Defaults to true on Windows [$NVRH_CLIENT_USE_PORTS]",
@@ -762,6 +1093,18 @@ var CliClientReconnectCommand = cli.Command{
 			Sources: cli.EnvVars("NVRH_CLIENT_DEBUG"),
 		},
 
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "Profile from the config file to apply on top of the server's settings",
+			Sources: cli.EnvVars("NVRH_CLIENT_PROFILE"),
+		},
+
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "Path to the config file. Defaults to $XDG_CONFIG_HOME/nvrh/config.yml",
+			Sources: cli.EnvVars("NVRH_CONFIG"),
+		},
+
 		&cli.StringSliceFlag{
 			Name:  "local-editor",
 			Usage: "Local editor to use. {{SOCKET_PATH}} will be replaced with the socket path [$NVRH_CLIENT_LOCAL_EDITOR]",
@@ -770,26 +1113,61 @@ var CliClientReconnectCommand = cli.Command{
 		},
 
 		&cli.StringSliceFlag{
-			Name:  "ssh-arg",
-			Usage: "Additional arguments to pass to the SSH command [$NVRH_CLIENT_SSH_ARG]",
-			// Sources: cli.EnvVars("NVRH_CLIENT_SSH_ARG"),
+			Name:  "open-url-cmd",
+			Usage: "Command to open URLs with. {{URL}} will be replaced with the URL. Defaults to the system handler [$NVRH_CLIENT_OPEN_URL_CMD]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CMD"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-scheme",
+			Usage: "URL schemes the server may open locally, like mailto [$NVRH_CLIENT_OPEN_URL_SCHEME]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_SCHEME"),
+			Value: url_policy.DefaultSchemes,
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-allow-host",
+			Usage: "Hosts the server may open URLs for, like *.github.com. Defaults to any host [$NVRH_CLIENT_OPEN_URL_ALLOW_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_ALLOW_HOST"),
+		},
+
+		&cli.StringSliceFlag{
+			Name:  "open-url-deny-host",
+			Usage: "Hosts the server may not open URLs for, even if allowed [$NVRH_CLIENT_OPEN_URL_DENY_HOST]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_DENY_HOST"),
+		},
+
+		&cli.BoolFlag{
+			Name:  "open-url-confirm",
+			Usage: "Ask on this machine before opening URLs or files from the server [$NVRH_CLIENT_OPEN_URL_CONFIRM]",
+			// Sources: cli.EnvVars("NVRH_CLIENT_OPEN_URL_CONFIRM"),
+		},
+
+		&cli.BoolFlag{
+			Name:    "enable-clipboard",
+			Usage:   "Use the local clipboard for the + and * registers in the remote nvim",
+			Sources: cli.EnvVars("NVRH_CLIENT_CLIPBOARD"),
+			Value:   true,
+		},
+
+		&cli.BoolFlag{
+			Name:    "forward-notifications",
+			Usage:   "Show vim.notify warnings and errors, and terminal notifications, on the desktop",
+			Sources: cli.EnvVars("NVRH_CLIENT_FORWARD_NOTIFICATIONS"),
 		},
 
 		&cli.StringFlag{
 			Name:  "insecure-direct-connect",
 			Usage: "Opens a public port on the server and connects directly to it. Use 'true' to connect to the server you're already passing",
 		},
-	},
+	}, transportFlags()),
 
 	Action: func(ctx context.Context, cmd *cli.Command) error {
-		cfg, err := nvrh_config.LoadConfig(nvrh_config.DefaultConfigPath())
+		cfg, err := nvrh_config.Load(cmd.String("config"))
 		if err != nil {
 			return err
 		}
 
-		isDebug := cmd.Bool("debug")
-		logger.PrepareLogger(isDebug)
-
 		// Prepare the context.
 		server := cmd.Args().Get(0)
 		if server == "" {
@@ -806,12 +1184,18 @@ var CliClientReconnectCommand = cli.Command{
 			return endpointErr
 		}
 
-		serverConfig := cfg.Servers[endpoint.GivenHost]
-		if err := nvrh_config.ApplyPrecedence(cmd, cfg.Default, serverConfig); err != nil {
+		defaultConfig, serverConfig, err := cfg.Resolve(endpoint.ConfigKey(), cmd.String("profile"))
+		if err != nil {
+			return err
+		}
+		if err := nvrh_config.ApplyPrecedence(cmd, defaultConfig, serverConfig); err != nil {
 			return err
 		}
 
-		sshPath := getSshPath(cmd.String("ssh-path"))
+		isDebug := cmd.Bool("debug")
+		logger.PrepareLogger(isDebug)
+
+		endpoint.ResolveSshConfig(cmd.String("ssh-path"))
 
 		directConnectHost := cmd.String("insecure-direct-connect")
 		if directConnectHost == "true" {
@@ -835,13 +1219,21 @@ var CliClientReconnectCommand = cli.Command{
 
 			Debug: isDebug,
 
-			TunneledPorts: make(map[string]bool),
+			TunneledPorts: make(map[string]string),
+
+			ForwardAgent: optionalBool(cmd, "forward-agent"),
+
+			Proxy: cmd.String("proxy"),
+
+			Clipboard:            cmd.Bool("enable-clipboard"),
+			ForwardNotifications: cmd.Bool("forward-notifications"),
+			OpenUrlCmd:           cmd.StringSlice("open-url-cmd"),
+			UrlPolicy:            urlPolicyFromFlags(cmd),
 
 			// NvimCmd: c.StringSlice("nvim-cmd"),
 		}
 
 		localEditor := cmd.StringSlice("local-editor")
-		sshArgs := cmd.StringSlice("ssh-arg")
 
 		shouldUsePorts := cmd.Bool("use-ports")
 		if directConnectHost != "" {
@@ -855,7 +1247,7 @@ var CliClientReconnectCommand = cli.Command{
 		remotePortNumber := randomPort
 
 		// Setup SSH client
-		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, sshPath, sshArgs)
+		sshClient, sshClientErr := getSshClient(nvrhContext, endpoint, cmd)
 		if sshClientErr != nil {
 			return sshClientErr
 		}
@@ -887,6 +1279,7 @@ var CliClientReconnectCommand = cli.Command{
 			closeNvimSocket(nv, false)
 			killAllCmds(nvrhContext.CommandsToKill)
 			os.Remove(localSocketPath)
+			removeOpenedFiles(nvrhContext)
 			if nvrhContext.SshClient != nil {
 				nvrhContext.SshClient.Close()
 			}
@@ -991,57 +1384,123 @@ func prepareRemoteNvim(
 ) error {
 	slog.Info("Preparing remote nvim", "sessionId", nvrhContext.SessionId)
 
+	// The bridge scripts talk to nvim from the remote through its socket.
+	remoteAddress := ti.RemoteBoundToIp()
+	assumedUiChannel := nv.ChannelID() + 1
+	if ti.Stdio {
+		// Nothing may listen on the server in stdio mode, not even the server
+		// nvim starts on its own. Without one the bridge scripts can't work,
+		// so they're left out.
+		if err := nv.ExecLua("for _, address in ipairs(vim.fn.serverlist()) do vim.fn.serverstop(address) end", nil); err != nil {
+			return err
+		}
+		remoteAddress = ""
+
+		// The UI shares nvrh's channel.
+		assumedUiChannel = nv.ChannelID()
+	}
+
 	//Setup channel info for the remote nvim instance.
 	currentUser, _ := user.Current()
 	hostname, _ := os.Hostname()
 
-	nv.SetClientInfo(
-		"nvrh",
-		nvim.ClientVersion{},
-		"rpc",
-		map[string]*nvim.ClientMethod{
-			"tunnel-port": {
-				Async: true,
-				NArgs: nvim.ClientMethodNArgs{
-					Min: 1,
-					Max: 1,
-				},
+	clientMethods := map[string]*nvim.ClientMethod{
+		"tunnel-port": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 1,
+				Max: 1,
+			},
+		},
+
+		"open-remote-file": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 1,
+				Max: 1,
 			},
+		},
+
+		"open-url": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 1,
+				Max: 1,
+			},
+		},
+
+		"notify": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 1,
+				Max: 3,
+			},
+		},
 
-			"open-url": {
-				Async: true,
-				NArgs: nvim.ClientMethodNArgs{
-					Min: 1,
-					Max: 1,
-				},
+		"download": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 1,
+				Max: 2,
 			},
 		},
+
+		"upload": {
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 2,
+				Max: 2,
+			},
+		},
+	}
+
+	// Without these, nothing on the server can reach the local clipboard.
+	if nvrhContext.Clipboard {
+		clientMethods["clipboard-copy"] = &nvim.ClientMethod{
+			Async: true,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 2,
+				Max: 2,
+			},
+		}
+
+		clientMethods["clipboard-paste"] = &nvim.ClientMethod{
+			Async: false,
+			NArgs: nvim.ClientMethodNArgs{
+				Min: 0,
+				Max: 0,
+			},
+		}
+	}
+
+	nv.SetClientInfo(
+		"nvrh",
+		nvim.ClientVersion{},
+		"rpc",
+		clientMethods,
 		nvim.ClientAttributes{
 			"nvrh_version":         version,
 			"nvrh_client_username": currentUser.Username,
 			"nvrh_client_hostname": hostname,
 			"nvrh_client_os":       runtime.GOOS,
 			// Assume the UI channel is the next channel.
-			"nvrh_assumed_ui_channel": fmt.Sprintf("%d", nv.ChannelID()+1),
+			"nvrh_assumed_ui_channel": fmt.Sprintf("%d", assumedUiChannel),
 		},
 	)
 
 	// Register RPC handlers.
 	nv.RegisterHandler("tunnel-port", func(v *nvim.Nvim, args []string) {
-		if _, ok := nvrhContext.TunneledPorts[args[0]]; ok {
-			return
-		}
-
-		nvrhContext.TunneledPorts[args[0]] = true
-
-		go nvrhContext.SshClient.TunnelSocket(&ssh_tunnel_info.SshTunnelInfo{
-			Mode:         "port",
-			LocalSocket:  args[0],
-			RemoteSocket: args[0],
-			Public:       true,
-		})
+		tunnelPort(v, nvrhContext, args[0], true)
 	})
-	nv.RegisterHandler("open-url", RpcHandleOpenUrl)
+	nv.RegisterHandler("open-url", RpcHandleOpenUrl(nvrhContext))
+	nv.RegisterHandler("open-remote-file", RpcHandleOpenRemoteFile(nvrhContext))
+	nv.RegisterHandler("notify", RpcHandleNotify(nvrhContext))
+	if nvrhContext.Clipboard {
+		nv.RegisterHandler("clipboard-copy", RpcHandleClipboardCopy)
+		nv.RegisterHandler("clipboard-paste", RpcHandleClipboardPaste)
+	}
+	nv.RegisterHandler("download", RpcHandleDownload(nvrhContext))
+	nv.RegisterHandler("upload", RpcHandleUpload(nvrhContext))
 
 	// Prepare bridge code.
 	browserScriptPath := pathWithBatExtension(
@@ -1054,7 +1513,7 @@ func prepareRemoteNvim(
 	browserShellScript := bridge_files.ReadFileWithTemplate(
 		pathWithBatExtension([]string{"shell/nvrh-browser"}, nvrhContext.ServerInfo.Os),
 		map[string]any{
-			"SocketPath": ti.RemoteBoundToIp(),
+			"SocketPath": remoteAddress,
 		},
 	)
 
@@ -1068,10 +1527,42 @@ func prepareRemoteNvim(
 	editorShellScript := bridge_files.ReadFileWithTemplate(
 		pathWithBatExtension([]string{"shell/nvrh-editor"}, nvrhContext.ServerInfo.Os),
 		map[string]any{
-			"SocketPath": ti.RemoteBoundToIp(),
+			"SocketPath": remoteAddress,
 		},
 	)
 
+	notifyScriptPath := pathWithBatExtension(
+		[]string{
+			nvrhContext.ServerInfo.Tmpdir,
+			fmt.Sprintf("nvrh-notify-%s", nvrhContext.SessionId),
+		},
+		nvrhContext.ServerInfo.Os,
+	)
+	notifyShellScript := bridge_files.ReadFileWithTemplate(
+		pathWithBatExtension([]string{"shell/nvrh-notify"}, nvrhContext.ServerInfo.Os),
+		map[string]any{
+			"SocketPath": remoteAddress,
+		},
+	)
+
+	clipboardScriptPath := pathWithBatExtension(
+		[]string{
+			nvrhContext.ServerInfo.Tmpdir,
+			fmt.Sprintf("nvrh-clipboard-%s", nvrhContext.SessionId),
+		},
+		nvrhContext.ServerInfo.Os,
+	)
+	clipboardShellScript := bridge_files.ReadFileWithTemplate(
+		pathWithBatExtension([]string{"shell/nvrh-clipboard"}, nvrhContext.ServerInfo.Os),
+		map[string]any{
+			"SocketPath": remoteAddress,
+		},
+	)
+
+	if ti.Stdio {
+		browserScriptPath, editorScriptPath, notifyScriptPath, clipboardScriptPath = "", "", "", ""
+	}
+
 	marshalled, err := json.Marshal(nvrhContext.ServerInfo)
 	if err != nil {
 		return err
@@ -1086,25 +1577,52 @@ func prepareRemoteNvim(
 		// Maybe use VimLeavePre or nvrh custom on_quit?
 		browserScriptPath,
 		editorScriptPath,
-		ti.RemoteBoundToIp(),
+		remoteAddress,
 		nvrhContext.WindowsLauncherPath,
 	)
 
 	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_open_url.lua"), nil, browserScriptPath)
-	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
-		browserScriptPath,
-		browserShellScript,
-		"rwxr-xr-x",
-	)
+	if browserScriptPath != "" {
+		batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
+			browserScriptPath,
+			browserShellScript,
+			"rwxr-xr-x",
+		)
+	}
 
 	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_open_file.lua"), nil, editorScriptPath)
-	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
-		editorScriptPath,
-		editorShellScript,
-		"rwxr-xr-x",
-	)
+	if editorScriptPath != "" {
+		batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
+			editorScriptPath,
+			editorShellScript,
+			"rwxr-xr-x",
+		)
+	}
 
 	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_tunnel_port.lua"), nil)
+	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_notify.lua"), nil,
+		notifyScriptPath,
+		nvrhContext.ForwardNotifications,
+	)
+	if notifyScriptPath != "" {
+		batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
+			notifyScriptPath,
+			notifyShellScript,
+			"rwxr-xr-x",
+		)
+	}
+	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_clipboard.lua"), nil,
+		clipboardScriptPath,
+		nvrhContext.Clipboard,
+	)
+	if nvrhContext.Clipboard && clipboardScriptPath != "" {
+		batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_remote_file_on_init.lua"), nil,
+			clipboardScriptPath,
+			clipboardShellScript,
+			"rwxr-xr-x",
+		)
+	}
+	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/rpc_file_transfer.lua"), nil)
 	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/setup_port_scanner.lua"), nil, nvrhContext.AutomapPorts)
 	batch.ExecLua(bridge_files.ReadFileWithoutError("lua/session_automap_ports.lua"), nil, nv.ChannelID())
 
@@ -1119,26 +1637,306 @@ func prepareRemoteNvim(
 	return nil
 }
 
-func RpcHandleOpenUrl(v *nvim.Nvim, args []string) {
-	goos := runtime.GOOS
-	url := args[0]
+func RpcHandleOpenUrl(nvrhContext *nvrh_context.NvrhContext) func(v *nvim.Nvim, args []string) {
+	return func(v *nvim.Nvim, args []string) {
+		rawUrl := args[0]
 
-	if url == "" || !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
-		slog.Error("Invalid url", "url", url)
-		return
+		// A file URL names a file on the server, never one on this machine.
+		if parsed, err := url.Parse(rawUrl); err == nil && strings.EqualFold(parsed.Scheme, "file") {
+			RpcHandleOpenRemoteFile(nvrhContext)(v, []string{parsed.Path})
+			return
+		}
+
+		if err := nvrhContext.UrlPolicy.Check(rawUrl); err != nil {
+			slog.Warn("Refusing to open url", "url", rawUrl, "err", err)
+			notifyRemote(v, fmt.Sprintf("nvrh: not opening %s: %s", rawUrl, err), "WARN")
+			return
+		}
+
+		go func() {
+			if nvrhContext.UrlPolicy.Confirm {
+				message := fmt.Sprintf("%s wants to open:\n\n%s", nvrhContext.Endpoint.Given, rawUrl)
+				if !confirmLocally(v, message, "Open") {
+					notifyRemote(v, fmt.Sprintf("nvrh: opening %s was declined", rawUrl), "WARN")
+					return
+				}
+			}
+
+			// Only tunnel once the URL is going to be opened.
+			rewrittenUrl, localPort := rewriteLocalhostUrl(v, nvrhContext, rawUrl)
+
+			slog.Info("Opening url", "url", rewrittenUrl)
+
+			// Give the tunnel a moment to start listening, so the browser
+			// doesn't race it.
+			if localPort != "" {
+				waitForLocalPort(localPort, 2*time.Second)
+			}
+
+			if err := openUrlLocally(nvrhContext.OpenUrlCmd, rewrittenUrl); err != nil {
+				slog.Error("Failed to open url", "url", rewrittenUrl, "err", err)
+			}
+		}()
 	}
+}
 
-	slog.Info("Opening url", "url", url)
+func urlPolicyFromFlags(cmd *cli.Command) *url_policy.Policy {
+	return &url_policy.Policy{
+		Schemes:    cmd.StringSlice("open-url-scheme"),
+		AllowHosts: cmd.StringSlice("open-url-allow-host"),
+		DenyHosts:  cmd.StringSlice("open-url-deny-host"),
+		Confirm:    cmd.Bool("open-url-confirm"),
+	}
+}
 
-	switch goos {
+// rewriteLocalhostUrl tunnels the port of a localhost URL and points the URL
+// at the local end of the tunnel, returning that port too. Localhost URLs in
+// query values, like an OAuth redirect_uri, are tunneled on the same port,
+// since they can't be changed. Other URLs are returned as they are.
+func rewriteLocalhostUrl(v *nvim.Nvim, nvrhContext *nvrh_context.NvrhContext, rawUrl string) (string, string) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || !strings.EqualFold(parsed.Scheme, "http") && !strings.EqualFold(parsed.Scheme, "https") {
+		return rawUrl, ""
+	}
+
+	for _, values := range parsed.Query() {
+		for _, value := range values {
+			remotePort := localhostPort(value)
+			if remotePort == "" {
+				continue
+			}
+
+			if localPort := tunnelPort(v, nvrhContext, remotePort, false); localPort != remotePort {
+				notifyRemote(v, fmt.Sprintf("nvrh: %s won't reach the server, since port %s is taken locally", value, remotePort), "WARN")
+			}
+		}
+	}
+
+	remotePort := localhostPort(rawUrl)
+	if remotePort == "" {
+		return rawUrl, ""
+	}
+
+	localPort := tunnelPort(v, nvrhContext, remotePort, false)
+
+	// The tunnel only listens on IPv4.
+	hostname := parsed.Hostname()
+	if hostname == "::1" {
+		hostname = "127.0.0.1"
+	}
+	parsed.Host = net.JoinHostPort(hostname, localPort)
+
+	return parsed.String(), localPort
+}
+
+// localhostPort returns the port of a http(s) URL on localhost, or "" for any
+// other URL.
+func localhostPort(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Port() == "" {
+		return ""
+	}
+
+	if !strings.EqualFold(parsed.Scheme, "http") && !strings.EqualFold(parsed.Scheme, "https") {
+		return ""
+	}
+
+	switch parsed.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return parsed.Port()
+	}
+
+	return ""
+}
+
+// tunnelPort tunnels a port on the server and returns the local port it's
+// reachable on. That's the same port, unless it's already taken locally.
+// Public tunnels listen on every interface, others only on loopback.
+func tunnelPort(v *nvim.Nvim, nvrhContext *nvrh_context.NvrhContext, remotePort string, public bool) string {
+	nvrhContext.TunneledPortsMutex.Lock()
+	if localPort, ok := nvrhContext.TunneledPorts[remotePort]; ok {
+		nvrhContext.TunneledPortsMutex.Unlock()
+		return localPort
+	}
+
+	bindIp := "127.0.0.1"
+	if public {
+		bindIp = "0.0.0.0"
+	}
+
+	localPort := remotePort
+	isTaken := false
+	if listener, err := net.Listen("tcp", net.JoinHostPort(bindIp, localPort)); err == nil {
+		listener.Close()
+	} else {
+		localPort = fmt.Sprintf("%d", getRandomPort())
+		isTaken = true
+	}
+
+	nvrhContext.TunneledPorts[remotePort] = localPort
+	nvrhContext.TunneledPortsMutex.Unlock()
+
+	if isTaken {
+		slog.Warn("Port is taken locally", "remotePort", remotePort, "localPort", localPort)
+		notifyRemote(v, fmt.Sprintf("nvrh: port %s is taken locally, tunneling it to %s", remotePort, localPort), "WARN")
+	}
+
+	go nvrhContext.SshClient.TunnelSocket(&ssh_tunnel_info.SshTunnelInfo{
+		Mode:         "port",
+		LocalSocket:  localPort,
+		RemoteSocket: remotePort,
+		Public:       public,
+	})
+
+	return localPort
+}
+
+func waitForLocalPort(port string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), 100*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// openUrlLocally opens a URL with openUrlCmd, replacing {{URL}}, or with the
+// default handler when it's empty.
+func openUrlLocally(openUrlCmd []string, target string) error {
+	if len(openUrlCmd) == 0 {
+		return openLocally(target)
+	}
+
+	replacedArgs := make([]string, len(openUrlCmd))
+	for i, arg := range openUrlCmd {
+		replacedArgs[i] = strings.ReplaceAll(arg, "{{URL}}", target)
+	}
+
+	return exec.Command(replacedArgs[0], replacedArgs[1:]...).Run()
+}
+
+// openLocally opens a URL or file with the default handler on this machine.
+func openLocally(target string) error {
+	switch goos := runtime.GOOS; goos {
 	case "darwin":
-		exec.Command("open", url).Run()
+		return exec.Command("open", target).Run()
 	case "linux":
-		exec.Command("xdg-open", url).Run()
+		return exec.Command("xdg-open", target).Run()
 	case "windows":
-		exec.Command("cmd", "/c", "start", url).Run()
+		// The empty argument is the window title, which start would otherwise
+		// take from a quoted target.
+		return exec.Command("cmd", "/c", "start", "", target).Run()
 	default:
-		slog.Error("Don't know how to open url", "url", url, "os", goos)
+		return fmt.Errorf("don't know how to open files on %s", goos)
+	}
+}
+
+// RpcHandleNotify shows a desktop notification. The remote nvim passes the
+// message, and optionally a title and a level.
+func RpcHandleNotify(nvrhContext *nvrh_context.NvrhContext) func(v *nvim.Nvim, args []string) {
+	return func(v *nvim.Nvim, args []string) {
+		message := args[0]
+
+		title := fmt.Sprintf("nvrh: %s", nvrhContext.Endpoint.Given)
+		if len(args) > 1 && args[1] != "" {
+			title = args[1]
+		}
+
+		level := local_notify.LevelInfo
+		if len(args) > 2 {
+			level = args[2]
+		}
+
+		slog.Info("Showing notification", "title", title, "level", level)
+
+		if err := local_notify.Show(title, message, level); err != nil {
+			slog.Error("Failed to show notification", "err", err)
+		}
+	}
+}
+
+func RpcHandleClipboardCopy(v *nvim.Nvim, lines []string, regtype string) {
+	text := strings.Join(lines, "\n")
+	if regtype == "V" {
+		text += "\n"
+	}
+
+	if err := local_clipboard.Copy(text); err != nil {
+		slog.Error("Failed to copy to the clipboard", "err", err)
+	}
+}
+
+func RpcHandleClipboardPaste(v *nvim.Nvim) ([]any, error) {
+	text, err := local_clipboard.Paste()
+	if err != nil {
+		slog.Error("Failed to paste from the clipboard", "err", err)
+		return nil, err
+	}
+
+	regtype := "v"
+	if strings.HasSuffix(text, "\n") {
+		regtype = "V"
+		text = strings.TrimSuffix(text, "\n")
+	}
+
+	return []any{strings.Split(text, "\n"), regtype}, nil
+}
+
+// serveNvimOverStdio starts nvim with its RPC channel on the command's stdio,
+// and shares it on the local side of the tunnel until nvim exits.
+func serveNvimOverStdio(
+	nvrhContext *nvrh_context.NvrhContext,
+	command string,
+	ti *ssh_tunnel_info.SshTunnelInfo,
+) error {
+	listener, err := nvrh_internal_ssh.LocalListenerFromTunnelInfo(ti)
+	if err != nil {
+		return err
+	}
+
+	stream, err := nvrhContext.SshClient.RunStdio(command)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	defer stream.Close()
+
+	return rpc_mux.New(stream).Serve(listener)
+}
+
+// checkRemoteNvimVersion refuses nvim that's too old for the bridge code,
+// which would otherwise break in confusing ways later on.
+func checkRemoteNvimVersion(version *nvim_helpers.NvimVersion) error {
+	if version == nil || version.AtLeast(nvim_helpers.MinimumNvimVersion) {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"nvim %s on the server is too old, nvrh needs %s or newer. Set nvim-cmd to a newer nvim, or use --bootstrap-nvim always to install one",
+		version,
+		nvim_helpers.MinimumNvimVersion,
+	)
+}
+
+// warnOnNvimVersionMismatch warns when the local UI and the remote nvim
+// differ in major / minor version, since the UI protocol changes between them.
+func warnOnNvimVersionMismatch(local *nvim_helpers.NvimVersion, remote *nvim_helpers.NvimVersion) {
+	if local == nil || remote == nil {
+		return
+	}
+
+	if local.Major != remote.Major || local.Minor != remote.Minor {
+		slog.Warn(
+			"Local and remote nvim versions differ, which can cause glitches in the UI",
+			"local", local.String(),
+			"remote", remote.String(),
+		)
 	}
 }
 
@@ -1191,21 +1989,68 @@ func getSshPath(given string) string {
 func getSshClient(
 	nvrhContext *nvrh_context.NvrhContext,
 	endpoint *ssh_endpoint.SshEndpoint,
-	sshPath string,
-	sshArgs []string,
+	cmd *cli.Command,
 ) (nvrh_base_ssh.BaseNvrhSshClient, error) {
+	if endpoint.Scheme == ssh_endpoint.SchemeDocker {
+		dockerUser := endpoint.GivenUser
+		if dockerUser == "" {
+			dockerUser = cmd.String("docker-user")
+		}
+
+		return nvrh_base_ssh.BaseNvrhSshClient(nvrh_docker_ssh.NewNvrhDockerSshClient(
+			nvrhContext,
+			cmd.String("docker-path"),
+			endpoint.GivenHost,
+			dockerUser,
+		)), nil
+	}
+
+	if endpoint.Scheme == ssh_endpoint.SchemeK8s {
+		return nvrh_base_ssh.BaseNvrhSshClient(nvrh_k8s_ssh.NewNvrhK8sSshClient(
+			nvrhContext,
+			cmd.String("kubectl-path"),
+			cmd.String("kube-context"),
+			endpoint.Namespace,
+			endpoint.GivenHost,
+			endpoint.Container,
+		)), nil
+	}
+
+	sshPath := getSshPath(cmd.String("ssh-path"))
+	sshArgs := cmd.StringSlice("ssh-arg")
+
+	if sshPath == "local" {
+		return nvrh_base_ssh.BaseNvrhSshClient(&nvrh_local_ssh.NvrhLocalSshClient{
+			Ctx: nvrhContext,
+		}), nil
+	}
+
 	if sshPath == "internal" {
-		sshClient, err := go_ssh_ext.GetSshClientForEndpoint(endpoint)
+		sshClient, err := go_ssh_ext.GetSshClientForEndpoint(endpoint, nvrhContext.Proxy)
 		if err != nil {
 			return nil, err
 		}
 
+		forwardedAgent, err := go_ssh_ext.GetForwardedAgentForEndpoint(endpoint, nvrhContext.ForwardAgent)
+		if err != nil {
+			slog.Warn("Agent forwarding disabled", "err", err)
+		}
+
 		return nvrh_base_ssh.BaseNvrhSshClient(&nvrh_internal_ssh.NvrhInternalSshClient{
 			Ctx:       nvrhContext,
 			SshClient: sshClient,
+			Agent:     forwardedAgent,
 		}), nil
 	}
 
+	if nvrhContext.ForwardAgent != nil {
+		if *nvrhContext.ForwardAgent {
+			sshArgs = append(sshArgs, "-A")
+		} else {
+			sshArgs = append(sshArgs, "-a")
+		}
+	}
+
 	return nvrh_base_ssh.BaseNvrhSshClient(&nvrh_binary_ssh.NvrhBinarySshClient{
 		Ctx:     nvrhContext,
 		SshPath: sshPath,
@@ -1213,6 +2058,17 @@ func getSshClient(
 	}), nil
 }
 
+// optionalBool returns the value of a bool flag, or nil if it wasn't given by
+// a flag, environment variable or the config file.
+func optionalBool(cmd *cli.Command, name string) *bool {
+	if !cmd.IsSet(name) {
+		return nil
+	}
+
+	value := cmd.Bool(name)
+	return &value
+}
+
 func getRandomPort() int {
 	min := 1025
 	max := 65535
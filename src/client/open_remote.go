@@ -0,0 +1,303 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/neovim/go-client/nvim"
+
+	nvrh_context "nvrh/src/context"
+	"nvrh/src/file_transfer"
+	"nvrh/src/nvrh_base_ssh"
+)
+
+// launcherExtensions are files the default handler runs rather than shows,
+// which the server must never get to open.
+var launcherExtensions = []string{
+	// Windows
+	".exe", ".com", ".bat", ".cmd", ".msi", ".msp", ".lnk", ".url", ".scr",
+	".pif", ".cpl", ".hta", ".ps1", ".vbs", ".vbe", ".js", ".jse", ".wsf",
+	".wsh", ".reg", ".appref-ms", ".application",
+	// macOS
+	".app", ".command", ".tool", ".terminal", ".pkg", ".mpkg", ".workflow",
+	".scpt", ".applescript", ".webloc", ".fileloc", ".inetloc",
+	// Linux and anywhere else
+	".desktop", ".sh", ".run", ".appimage", ".jar",
+}
+
+// RpcHandleOpenRemoteFile opens a file from the server with the default
+// handler on this machine. The remote nvim passes an absolute path.
+//
+// It goes through the URL policy as a `file://` URL, and launchers are
+// always refused. Most files are downloaded to a temporary directory first.
+// HTML is served from a local web server instead, so relative links to
+// stylesheets, scripts and images are fetched from the server too.
+func RpcHandleOpenRemoteFile(nvrhContext *nvrh_context.NvrhContext) func(v *nvim.Nvim, args []string) {
+	return func(v *nvim.Nvim, args []string) {
+		remotePath := args[0]
+		name := remoteBase(remotePath)
+
+		if err := checkRemoteFile(nvrhContext, remotePath); err != nil {
+			slog.Warn("Refusing to open remote file", "remotePath", remotePath, "err", err)
+			notifyRemote(v, fmt.Sprintf("nvrh: not opening %s: %s", name, err), "WARN")
+			return
+		}
+
+		// Don't block other RPC handlers while copying.
+		go func() {
+			if nvrhContext.UrlPolicy.Confirm {
+				message := fmt.Sprintf("%s wants to open this file from the server:\n\n%s", nvrhContext.Endpoint.Given, remotePath)
+				if !confirmLocally(v, message, "Open") {
+					notifyRemote(v, fmt.Sprintf("nvrh: opening %s was declined", name), "WARN")
+					return
+				}
+			}
+
+			var target string
+			var err error
+
+			switch strings.ToLower(path.Ext(name)) {
+			case ".html", ".htm":
+				target, err = serveRemoteFile(nvrhContext, remotePath)
+			default:
+				target, err = downloadForOpening(v, nvrhContext, remotePath)
+			}
+
+			if err != nil {
+				slog.Error("Failed to open remote file", "remotePath", remotePath, "err", err)
+				notifyRemote(v, fmt.Sprintf("nvrh: opening %s failed: %s", name, err), "ERROR")
+				return
+			}
+
+			slog.Info("Opening remote file", "remotePath", remotePath, "target", target)
+
+			if err := openLocally(target); err != nil {
+				notifyRemote(v, fmt.Sprintf("nvrh: opening %s failed: %s", name, err), "ERROR")
+			}
+		}()
+	}
+}
+
+// checkRemoteFile returns an error saying why a remote file may not be
+// opened, or nil.
+func checkRemoteFile(nvrhContext *nvrh_context.NvrhContext, remotePath string) error {
+	ext := strings.ToLower(path.Ext(remoteBase(remotePath)))
+	if slices.Contains(launcherExtensions, ext) {
+		return fmt.Errorf("%s files could run code on this machine", ext)
+	}
+
+	// Windows paths like C:/Users need a leading slash to be a URL path.
+	fileUrl := url.URL{Scheme: "file", Path: "/" + strings.TrimPrefix(filepath.ToSlash(remotePath), "/")}
+
+	return nvrhContext.UrlPolicy.Check(fileUrl.String())
+}
+
+// downloadForOpening copies a remote file to a new temporary directory, so
+// a viewer still holding an earlier copy isn't disturbed.
+func downloadForOpening(v *nvim.Nvim, nvrhContext *nvrh_context.NvrhContext, remotePath string) (string, error) {
+	name := remoteBase(remotePath)
+
+	sessionDir := openedFilesDir(nvrhContext, "open")
+	if err := os.MkdirAll(sessionDir, 0700); err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp(sessionDir, "")
+	if err != nil {
+		return "", err
+	}
+
+	transfer := file_transfer.New(nvrhContext.SshClient)
+	defer transfer.Close()
+
+	localPath := filepath.Join(dir, name)
+	err = transfer.DownloadFile(remotePath, localPath, func(done int64, total int64) {
+		echoRemote(v, "nvrh: downloading "+formatProgress(name, done, total))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return localPath, nil
+}
+
+// openedFilesDir is where copies of remote files are kept for opening them,
+// until the session ends.
+func openedFilesDir(nvrhContext *nvrh_context.NvrhContext, kind string) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("nvrh-%s-%s", kind, nvrhContext.SessionId))
+}
+
+// removeOpenedFiles removes the copies made by RpcHandleOpenRemoteFile.
+func removeOpenedFiles(nvrhContext *nvrh_context.NvrhContext) {
+	for _, kind := range []string{"open", "serve"} {
+		if err := os.RemoveAll(openedFilesDir(nvrhContext, kind)); err != nil {
+			slog.Warn("Failed to remove opened files", "err", err)
+		}
+	}
+}
+
+var (
+	remoteFileServers      = map[string]string{}
+	remoteFileServersMutex sync.Mutex
+)
+
+// serveRemoteFile returns a local URL for a remote file, starting a server
+// for its directory if there isn't one already. The URL has a random token
+// in its path, so other processes on this machine can't read the directory.
+func serveRemoteFile(nvrhContext *nvrh_context.NvrhContext, remotePath string) (string, error) {
+	remoteDir := path.Dir(remotePath)
+
+	remoteFileServersMutex.Lock()
+	defer remoteFileServersMutex.Unlock()
+
+	baseUrl, ok := remoteFileServers[remoteDir]
+	if !ok {
+		cacheDir := openedFilesDir(nvrhContext, "serve")
+		if err := os.MkdirAll(cacheDir, 0700); err != nil {
+			return "", err
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+
+		token := make([]byte, 16)
+		if _, err := rand.Read(token); err != nil {
+			listener.Close()
+			return "", err
+		}
+
+		server := &remoteFileServer{
+			nvrhContext: nvrhContext,
+			remoteDir:   remoteDir,
+			cacheDir:    cacheDir,
+			prefix:      "/" + hex.EncodeToString(token),
+		}
+
+		go func() {
+			if err := http.Serve(listener, server); err != nil {
+				slog.Error("Remote file server stopped", "remoteDir", remoteDir, "err", err)
+			}
+		}()
+
+		baseUrl = fmt.Sprintf("http://%s%s", listener.Addr().String(), server.prefix)
+		remoteFileServers[remoteDir] = baseUrl
+
+		slog.Info("Serving remote directory", "remoteDir", remoteDir, "address", listener.Addr().String())
+	}
+
+	return baseUrl + "/" + url.PathEscape(path.Base(remotePath)), nil
+}
+
+// remoteFileServer serves files under remoteDir, fetching them from the
+// server on every request so reloading shows the latest version.
+type remoteFileServer struct {
+	nvrhContext *nvrh_context.NvrhContext
+	remoteDir   string
+	cacheDir    string
+	// Every URL starts with prefix, a random token.
+	prefix string
+
+	// transfer is kept between requests. It's reopened when it fails, or
+	// when the context's SSH client changes after reconnecting.
+	transfer       file_transfer.Transfer
+	transferClient nvrh_base_ssh.BaseNvrhSshClient
+	transferMutex  sync.Mutex
+}
+
+func (s *remoteFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rel, ok := strings.CutPrefix(r.URL.Path, s.prefix+"/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	rel = path.Clean("/" + rel)
+	if rel == "/" {
+		rel = "/index.html"
+	}
+
+	// Each request gets its own copy, so concurrent ones don't clash.
+	dir, err := os.MkdirTemp(s.cacheDir, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := filepath.Join(dir, path.Base(rel))
+	if err := s.fetch(path.Join(s.remoteDir, rel), localPath); err != nil {
+		slog.Debug("Failed to fetch remote file", "path", rel, "err", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// ServeContent, unlike ServeFile, doesn't redirect index.html.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// fetch downloads a remote file, trying once more with a fresh transfer if
+// the kept one fails, since its connection may be gone.
+func (s *remoteFileServer) fetch(remotePath string, localPath string) error {
+	transfer := s.currentTransfer()
+	if err := transfer.DownloadFile(remotePath, localPath, nil); err == nil {
+		return nil
+	}
+
+	s.dropTransfer(transfer)
+
+	return s.currentTransfer().DownloadFile(remotePath, localPath, nil)
+}
+
+func (s *remoteFileServer) currentTransfer() file_transfer.Transfer {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+
+	client := s.nvrhContext.SshClient
+	if s.transfer != nil && s.transferClient != client {
+		s.transfer.Close()
+		s.transfer = nil
+	}
+
+	if s.transfer == nil {
+		s.transfer = file_transfer.New(client)
+		s.transferClient = client
+	}
+
+	return s.transfer
+}
+
+func (s *remoteFileServer) dropTransfer(transfer file_transfer.Transfer) {
+	s.transferMutex.Lock()
+	defer s.transferMutex.Unlock()
+
+	if s.transfer == transfer {
+		s.transfer.Close()
+		s.transfer = nil
+	}
+}
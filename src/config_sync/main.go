@@ -0,0 +1,398 @@
+package config_sync
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nvrh/src/go_ssh_ext"
+	"nvrh/src/nvrh_base_ssh"
+)
+
+const (
+	manifestName = ".nvrh-manifest"
+	deletedName  = ".nvrh-deleted"
+
+	probeTimeout  = 20 * time.Second
+	uploadTimeout = 10 * time.Minute
+)
+
+// DefaultIgnore is used when no ignore list is given.
+var DefaultIgnore = []string{".git", "*.swp", "*~", ".DS_Store"}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+type manifestEntry struct {
+	Sum  string
+	Mode fs.FileMode
+}
+
+// Sync uploads a local nvim config directory into a cache dir on the server.
+// Only files that changed since the last sync are sent, based on a manifest of
+// checksums kept next to the config. It returns the environment variables
+// that make the remote nvim use the uploaded config.
+func Sync(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	localDir string,
+	ignore []string,
+) ([]string, error) {
+	root, err := expandHome(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ~/.config/nvim is often a symlink into a dotfiles repo.
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("sync-config: %w", err)
+	}
+
+	if ignore == nil {
+		ignore = DefaultIgnore
+	}
+
+	name := unsafeNameChars.ReplaceAllString(filepath.Base(root), "_")
+
+	localManifest, err := scan(root, ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteDir, remoteManifest, err := readRemoteManifest(sshClient, name)
+	if err != nil {
+		return nil, fmt.Errorf("sync-config needs a POSIX shell on the server: %w", err)
+	}
+
+	var changed []string
+	for relPath, entry := range localManifest {
+		if remoteManifest[relPath] != entry {
+			changed = append(changed, relPath)
+		}
+	}
+	sort.Strings(changed)
+
+	var deleted []string
+	for relPath := range remoteManifest {
+		if _, ok := localManifest[relPath]; !ok {
+			deleted = append(deleted, relPath)
+		}
+	}
+	sort.Strings(deleted)
+
+	slog.Info(
+		"Syncing nvim config",
+		"from", root,
+		"to", remoteDir,
+		"changed", len(changed),
+		"deleted", len(deleted),
+		"unchanged", len(localManifest)-len(changed),
+	)
+
+	if len(changed) > 0 || len(deleted) > 0 {
+		if err := upload(sshClient, root, remoteDir, localManifest, changed, deleted); err != nil {
+			return nil, err
+		}
+	}
+
+	// The remote shell expands $XDG_CONFIG_HOME before it's replaced, so the
+	// bridge can give it back to programs started from nvim.
+	return []string{
+		"NVRH_XDG_CONFIG_HOME=$XDG_CONFIG_HOME",
+		fmt.Sprintf("XDG_CONFIG_HOME=%s", path.Dir(remoteDir)),
+		fmt.Sprintf("NVIM_APPNAME=%s", name),
+	}, nil
+}
+
+func expandHome(dir string) (string, error) {
+	if dir != "~" && !strings.HasPrefix(dir, "~/") {
+		return dir, nil
+	}
+
+	home, err := go_ssh_ext.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(dir, "~")), nil
+}
+
+func isIgnored(relPath string, ignore []string) bool {
+	for _, pattern := range ignore {
+		if matched, _ := path.Match(pattern, relPath); matched {
+			return true
+		}
+
+		if matched, _ := path.Match(pattern, path.Base(relPath)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scan builds the manifest for the local directory, keyed by slash separated
+// paths relative to root.
+func scan(root string, ignore []string) (map[string]manifestEntry, error) {
+	manifest := map[string]manifestEntry{}
+
+	err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filePath == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if isIgnored(rel, ignore) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		// Follows symlinks, and skips anything that isn't a regular file.
+		info, err := os.Stat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		sum, err := checksum(filePath)
+		if err != nil {
+			return err
+		}
+
+		mode := fs.FileMode(0644)
+		if info.Mode()&0111 != 0 {
+			mode = 0755
+		}
+
+		manifest[rel] = manifestEntry{Sum: sum, Mode: mode}
+
+		return nil
+	})
+
+	return manifest, err
+}
+
+func checksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readRemoteManifest returns the directory the config is synced to on the
+// server, and the manifest from the last sync.
+func readRemoteManifest(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	name string,
+) (string, map[string]manifestEntry, error) {
+	output, err := nvrh_base_ssh.RunWithInput(
+		sshClient,
+		fmt.Sprintf(
+			`sh -c 'dir="${XDG_CACHE_HOME:-$HOME/.cache}/nvrh/sync-config/$0"; echo "dir=$dir"; echo nvrh-manifest; cat "$dir/%s" 2>/dev/null' %s`,
+			manifestName,
+			nvrh_base_ssh.ShellQuote(name),
+		),
+		nil,
+		probeTimeout,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	remoteDir := ""
+	manifest := map[string]manifestEntry{}
+	inManifest := false
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if !inManifest {
+			if value, ok := strings.CutPrefix(line, "dir="); ok {
+				remoteDir = value
+			} else if line == "nvrh-manifest" {
+				inManifest = true
+			}
+			continue
+		}
+
+		// <sha256> <mode> <path>
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		mode, err := strconv.ParseUint(parts[1], 8, 32)
+		if err != nil {
+			continue
+		}
+
+		manifest[parts[2]] = manifestEntry{Sum: parts[0], Mode: fs.FileMode(mode)}
+	}
+
+	if remoteDir == "" || !inManifest {
+		return "", nil, fmt.Errorf("unexpected output: %q", strings.TrimSpace(output))
+	}
+
+	return remoteDir, manifest, nil
+}
+
+func formatManifest(manifest map[string]manifestEntry) []byte {
+	relPaths := make([]string, 0, len(manifest))
+	for relPath := range manifest {
+		relPaths = append(relPaths, relPath)
+	}
+	sort.Strings(relPaths)
+
+	var b strings.Builder
+	for _, relPath := range relPaths {
+		entry := manifest[relPath]
+		fmt.Fprintf(&b, "%s %o %s\n", entry.Sum, entry.Mode, relPath)
+	}
+
+	return []byte(b.String())
+}
+
+// upload sends the changed files, the new manifest and the list of deleted
+// files as a tarball, and applies it on the server.
+func upload(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	root string,
+	remoteDir string,
+	manifest map[string]manifestEntry,
+	changed []string,
+	deleted []string,
+) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(writeTarball(writer, root, manifest, changed, deleted))
+	}()
+
+	output, err := nvrh_base_ssh.RunWithInput(
+		sshClient,
+		fmt.Sprintf(
+			`sh -c 'mkdir -p "$0" && cd "$0" && tar -xzf - && if [ -f %[1]s ]; then while IFS= read -r f; do rm -f -- "$f"; done < %[1]s; rm -f %[1]s; fi && echo nvrh-sync-ok' %[2]s`,
+			deletedName,
+			nvrh_base_ssh.ShellQuote(remoteDir),
+		),
+		reader,
+		uploadTimeout,
+	)
+	reader.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(output, "nvrh-sync-ok") {
+		return fmt.Errorf("syncing config on the server failed: %s", strings.TrimSpace(output))
+	}
+
+	return nil
+}
+
+func writeTarball(
+	w io.Writer,
+	root string,
+	manifest map[string]manifestEntry,
+	changed []string,
+	deleted []string,
+) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	addBytes := func(name string, contents []byte) error {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(contents)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+
+		_, err := tarWriter.Write(contents)
+		return err
+	}
+
+	for _, relPath := range changed {
+		if err := addFile(tarWriter, root, relPath, manifest[relPath].Mode); err != nil {
+			return err
+		}
+	}
+
+	if len(deleted) > 0 {
+		if err := addBytes(deletedName, []byte(strings.Join(deleted, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := addBytes(manifestName, formatManifest(manifest)); err != nil {
+		return err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+func addFile(tarWriter *tar.Writer, root string, relPath string, mode fs.FileMode) error {
+	file, err := os.Open(filepath.Join(root, filepath.FromSlash(relPath)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tarWriter.WriteHeader(&tar.Header{
+		Name:    relPath,
+		Mode:    int64(mode),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tarWriter, file)
+	return err
+}
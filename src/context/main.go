@@ -2,9 +2,12 @@ package context
 
 import (
 	"os/exec"
+	"sync"
 
+	"nvrh/src/nvim_helpers"
 	"nvrh/src/nvrh_base_ssh"
 	"nvrh/src/ssh_endpoint"
+	"nvrh/src/url_policy"
 )
 
 type NvrhContext struct {
@@ -12,7 +15,17 @@ type NvrhContext struct {
 	Endpoint        *ssh_endpoint.SshEndpoint
 	RemoteDirectory string
 
-	AutomapPorts bool
+	AutomapPorts         bool
+	Clipboard            bool
+	ForwardNotifications bool
+
+	OpenUrlCmd []string
+	UrlPolicy  *url_policy.Policy
+
+	// ForwardAgent is nil unless given explicitly, leaving it to ssh_config.
+	ForwardAgent *bool
+
+	Proxy string
 
 	CommandsToKill []*exec.Cmd
 
@@ -22,7 +35,11 @@ type NvrhContext struct {
 
 	NvimCmd []string
 
-	TunneledPorts map[string]bool
+	// TunneledPorts maps remote ports to the local ports they're tunneled
+	// to. RPC handlers run concurrently, so it's guarded by
+	// TunneledPortsMutex.
+	TunneledPorts      map[string]string
+	TunneledPortsMutex sync.Mutex
 
 	ServerInfo *NvrhServerInfo
 
@@ -38,4 +55,6 @@ type NvrhServerInfo struct {
 	Homedir   string `json:"homedir"`
 	Tmpdir    string `json:"tmpdir"`
 	ShellName string `json:"shell_name"`
+
+	Version *nvim_helpers.NvimVersion `json:"version,omitempty"`
 }
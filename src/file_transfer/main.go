@@ -0,0 +1,182 @@
+package file_transfer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+
+	"nvrh/src/go_ssh_ext"
+	"nvrh/src/nvrh_base_ssh"
+)
+
+// Progress is called while copying, with the bytes copied so far and the
+// total, which is 0 when it isn't known.
+type Progress func(done int64, total int64)
+
+// Transfer copies files and directories between this machine and the server.
+// Paths on the server are relative to the home directory, like with scp.
+type Transfer interface {
+	// Download copies remotePath to localPath. Files are overwritten, but a
+	// directory is copied into an existing one, leaving other files alone.
+	Download(remotePath string, localPath string, progress Progress) error
+	// DownloadFile is Download for a single file, and fails for directories
+	// and anything else that isn't a regular file.
+	DownloadFile(remotePath string, localPath string, progress Progress) error
+	// Upload copies localPath to remotePath, the same way as Download.
+	Upload(localPath string, remotePath string, progress Progress) error
+	// RemoteExists reports whether something exists at remotePath.
+	RemoteExists(remotePath string) (bool, error)
+	Close() error
+}
+
+// New picks the best way to transfer files with the client: SFTP when the
+// client can start the SFTP subsystem, and tar over a shell otherwise.
+func New(client nvrh_base_ssh.BaseNvrhSshClient) Transfer {
+	if opener, ok := client.(nvrh_base_ssh.SftpOpener); ok {
+		stream, err := opener.OpenSftp()
+		if err == nil {
+			sftpClient, err := sftp.NewClientPipe(stream, stream)
+			if err == nil {
+				return &sftpTransfer{client: sftpClient, stream: stream}
+			}
+
+			stream.Close()
+		}
+
+		slog.Warn("SFTP isn't available, falling back to tar", "err", err)
+	}
+
+	return &tarTransfer{client: client}
+}
+
+// ExpandLocalPath expands a leading `~` in a local path.
+func ExpandLocalPath(localPath string) (string, error) {
+	if localPath != "~" && !strings.HasPrefix(localPath, "~/") && !strings.HasPrefix(localPath, `~\`) {
+		return localPath, nil
+	}
+
+	home, err := go_ssh_ext.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, localPath[1:]), nil
+}
+
+// DefaultDownloadDir is where downloads go when no local path is given: the
+// Downloads folder when there is one, the current directory otherwise.
+func DefaultDownloadDir() string {
+	if home, err := go_ssh_ext.UserHomeDir(); err == nil {
+		downloads := filepath.Join(home, "Downloads")
+		if info, err := os.Stat(downloads); err == nil && info.IsDir() {
+			return downloads
+		}
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		return cwd
+	}
+
+	return "."
+}
+
+// remoteRelative turns `~/foo` into `foo`, which both SFTP and a shell
+// resolve relative to the home directory.
+func remoteRelative(remotePath string) string {
+	if remotePath == "~" {
+		return "."
+	}
+
+	return strings.TrimPrefix(remotePath, "~/")
+}
+
+// relativeTo returns a clean path from the server relative to the clean root
+// it was found under. A root of `.`, like for `~`, has every relative path
+// under it.
+func relativeTo(root string, remotePath string) (string, bool) {
+	if remotePath == root {
+		return "", true
+	}
+
+	if root == "." {
+		return remotePath, !strings.HasPrefix(remotePath, "/")
+	}
+
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return strings.CutPrefix(remotePath, prefix)
+}
+
+// localSize returns the size of a file, or of all files in a directory.
+func localSize(localPath string) int64 {
+	var total int64
+
+	filepath.Walk(localPath, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+
+	return total
+}
+
+// progressWriter counts bytes written through it and reports them, at most a
+// few times a second.
+type progressWriter struct {
+	done       int64
+	total      int64
+	progress   Progress
+	lastReport time.Time
+}
+
+func newProgressWriter(total int64, progress Progress) *progressWriter {
+	return &progressWriter{total: total, progress: progress}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+
+	if p.progress != nil && time.Since(p.lastReport) > 250*time.Millisecond {
+		p.lastReport = time.Now()
+		p.progress(p.done, p.total)
+	}
+
+	return len(b), nil
+}
+
+func (p *progressWriter) finish() {
+	if p.progress != nil {
+		p.progress(p.done, p.total)
+	}
+}
+
+// FormatBytes formats a byte count for progress messages.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func copyWithProgress(dst io.Writer, src io.Reader, counter *progressWriter) error {
+	_, err := io.Copy(io.MultiWriter(dst, counter), src)
+	return err
+}
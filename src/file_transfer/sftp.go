@@ -0,0 +1,194 @@
+package file_transfer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+type sftpTransfer struct {
+	client *sftp.Client
+	stream io.Closer
+}
+
+func (t *sftpTransfer) RemoteExists(remotePath string) (bool, error) {
+	_, err := t.client.Stat(remoteRelative(remotePath))
+	if err == nil {
+		return true, nil
+	}
+
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+func (t *sftpTransfer) Upload(localPath string, remotePath string, progress Progress) error {
+	remotePath = remoteRelative(remotePath)
+	counter := newProgressWriter(localSize(localPath), progress)
+
+	err := filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localPath, filePath)
+		if err != nil {
+			return err
+		}
+		target := path.Join(remotePath, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return t.client.MkdirAll(target)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return t.uploadFile(filePath, target, info.Mode().Perm(), counter)
+	})
+
+	counter.finish()
+	return err
+}
+
+func (t *sftpTransfer) uploadFile(localPath string, remotePath string, mode os.FileMode, counter *progressWriter) error {
+	if dir := path.Dir(remotePath); dir != "." {
+		if err := t.client.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := t.client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+
+	if err := copyWithProgress(dst, src, counter); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return t.client.Chmod(remotePath, mode)
+}
+
+func (t *sftpTransfer) Download(remotePath string, localPath string, progress Progress) error {
+	remotePath = path.Clean(remoteRelative(remotePath))
+
+	var total int64
+	walker := t.client.Walk(remotePath)
+	for walker.Step() {
+		if walker.Err() == nil && walker.Stat().Mode().IsRegular() {
+			total += walker.Stat().Size()
+		}
+	}
+
+	counter := newProgressWriter(total, progress)
+	defer counter.finish()
+
+	walker = t.client.Walk(remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		rel, ok := relativeTo(remotePath, walker.Path())
+		if !ok {
+			return fmt.Errorf("unexpected path from the server: %s", walker.Path())
+		}
+		target := filepath.Join(localPath, filepath.FromSlash(rel))
+
+		// Names come from the server, so make sure they stay inside localPath.
+		if within, err := filepath.Rel(localPath, target); err != nil || within == ".." || strings.HasPrefix(within, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("unsafe path from the server: %s", walker.Path())
+		}
+
+		info := walker.Stat()
+		// Walk doesn't follow symlinks, and neither does the download.
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		if info.IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := t.downloadFile(walker.Path(), target, info.Mode().Perm(), counter); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *sftpTransfer) DownloadFile(remotePath string, localPath string, progress Progress) error {
+	remotePath = remoteRelative(remotePath)
+
+	info, err := t.client.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", remotePath)
+	}
+
+	counter := newProgressWriter(info.Size(), progress)
+	defer counter.finish()
+
+	return t.downloadFile(remotePath, localPath, info.Mode().Perm(), counter)
+}
+
+func (t *sftpTransfer) downloadFile(remotePath string, localPath string, mode os.FileMode, counter *progressWriter) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+
+	src, err := t.client.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if err := copyWithProgress(dst, src, counter); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+func (t *sftpTransfer) Close() error {
+	err := t.client.Close()
+	t.stream.Close()
+	return err
+}
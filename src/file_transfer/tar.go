@@ -0,0 +1,240 @@
+package file_transfer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nvrh/src/nvrh_base_ssh"
+)
+
+const tarTimeout = 30 * time.Minute
+
+// tarTransfer streams tarballs over a shell on the server, for transports
+// without SFTP, like containers.
+type tarTransfer struct {
+	client nvrh_base_ssh.BaseNvrhSshClient
+}
+
+func (t *tarTransfer) RemoteExists(remotePath string) (bool, error) {
+	output, err := nvrh_base_ssh.RunWithInput(
+		t.client,
+		fmt.Sprintf(`sh -c 'if [ -e "$0" ]; then echo nvrh-exists; else echo nvrh-missing; fi' %s`, nvrh_base_ssh.ShellQuote(remoteRelative(remotePath))),
+		nil,
+		20*time.Second,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case strings.Contains(output, "nvrh-exists"):
+		return true, nil
+	case strings.Contains(output, "nvrh-missing"):
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected output: %q", strings.TrimSpace(output))
+	}
+}
+
+func (t *tarTransfer) Upload(localPath string, remotePath string, progress Progress) error {
+	remotePath = path.Clean(remoteRelative(remotePath))
+	counter := newProgressWriter(localSize(localPath), progress)
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeLocalTar(writer, localPath, path.Base(remotePath), counter))
+	}()
+
+	// Replace what's there, like the SFTP transfer does.
+	output, err := nvrh_base_ssh.RunWithInput(
+		t.client,
+		fmt.Sprintf(
+			`sh -c 'mkdir -p "$0" && cd "$0" && rm -rf "./$1" && tar -xf - && echo nvrh-upload-ok' %s %s`,
+			nvrh_base_ssh.ShellQuote(path.Dir(remotePath)),
+			nvrh_base_ssh.ShellQuote(path.Base(remotePath)),
+		),
+		reader,
+		tarTimeout,
+	)
+	reader.Close()
+	counter.finish()
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(output, "nvrh-upload-ok") {
+		return fmt.Errorf("upload failed: %s", strings.TrimSpace(output))
+	}
+
+	return nil
+}
+
+func writeLocalTar(w io.Writer, localPath string, name string, counter *progressWriter) error {
+	tarWriter := tar.NewWriter(w)
+
+	err := filepath.Walk(localPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localPath, filePath)
+		if err != nil {
+			return err
+		}
+		entryName := path.Join(name, filepath.ToSlash(rel))
+
+		if info.IsDir() {
+			return tarWriter.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     entryName + "/",
+				Mode:     int64(info.Mode().Perm()),
+				ModTime:  info.ModTime(),
+			})
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:    entryName,
+			Mode:    int64(info.Mode().Perm()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}); err != nil {
+			return err
+		}
+
+		return copyWithProgress(tarWriter, file, counter)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tarWriter.Close()
+}
+
+func (t *tarTransfer) Download(remotePath string, localPath string, progress Progress) error {
+	remotePath = path.Clean(remoteRelative(remotePath))
+
+	stream, err := t.client.RunStdio(fmt.Sprintf(
+		`sh -c 'cd "$0" && tar -cf - "$1"' %s %s`,
+		nvrh_base_ssh.ShellQuote(path.Dir(remotePath)),
+		nvrh_base_ssh.ShellQuote(path.Base(remotePath)),
+	))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if closer, ok := stream.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+
+	counter := newProgressWriter(0, progress)
+	defer counter.finish()
+
+	return extractTar(stream, path.Base(remotePath), localPath, counter)
+}
+
+func (t *tarTransfer) DownloadFile(remotePath string, localPath string, progress Progress) error {
+	remotePath = path.Clean(remoteRelative(remotePath))
+
+	// -h stores what a symlink points to, like the SFTP transfer reads it.
+	stream, err := t.client.RunStdio(fmt.Sprintf(
+		`sh -c 'cd "$0" && if [ -f "$1" ]; then tar -chf - "$1"; else echo "$1 is not a file" >&2; fi' %s %s`,
+		nvrh_base_ssh.ShellQuote(path.Dir(remotePath)),
+		nvrh_base_ssh.ShellQuote(path.Base(remotePath)),
+	))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if closer, ok := stream.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+
+	counter := newProgressWriter(0, progress)
+	defer counter.finish()
+
+	return extractTar(stream, path.Base(remotePath), localPath, counter)
+}
+
+// extractTar extracts a tarball whose entries all live under name, putting
+// name itself at localPath.
+func extractTar(r io.Reader, name string, localPath string, counter *progressWriter) error {
+	tarReader := tar.NewReader(r)
+	sawEntries := false
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, ok := relativeTo(name, path.Clean(header.Name))
+		if !ok {
+			return fmt.Errorf("unexpected entry in tarball: %s", header.Name)
+		}
+
+		if rel == ".." || strings.HasPrefix(rel, "../") || strings.Contains(rel, "/../") {
+			return fmt.Errorf("unsafe entry in tarball: %s", header.Name)
+		}
+
+		target := filepath.Join(localPath, filepath.FromSlash(rel))
+		sawEntries = true
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+
+			if err := copyWithProgress(file, tarReader, counter); err != nil {
+				file.Close()
+				return err
+			}
+
+			if err := file.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !sawEntries {
+		return fmt.Errorf("%s not found on the server", name)
+	}
+
+	return nil
+}
+
+func (t *tarTransfer) Close() error {
+	return nil
+}
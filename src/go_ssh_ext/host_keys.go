@@ -0,0 +1,225 @@
+package go_ssh_ext
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/skeema/knownhosts"
+	"golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+
+	"nvrh/src/ssh_endpoint"
+)
+
+// hostKeyPolicy holds the ssh_config options that control how host keys are
+// verified and recorded.
+type hostKeyPolicy struct {
+	// One of "yes", "accept-new", "no" or "ask".
+	strictHostKeyChecking string
+
+	userKnownHostsFiles   []string
+	globalKnownHostsFiles []string
+
+	hashKnownHosts bool
+	checkHostIp    bool
+}
+
+func getHostKeyPolicyForEndpoint(endpoint *ssh_endpoint.SshEndpoint) *hostKeyPolicy {
+	strict := strings.ToLower(endpoint.SshConfigGet("StrictHostKeyChecking"))
+	switch strict {
+	case "accept-new", "ask":
+	case "yes", "true":
+		strict = "yes"
+	case "no", "off", "false":
+		strict = "no"
+	default:
+		strict = "ask"
+	}
+
+	return &hostKeyPolicy{
+		strictHostKeyChecking: strict,
+
+		userKnownHostsFiles:   splitKnownHostsFiles(endpoint.SshConfigGet("UserKnownHostsFile"), endpoint),
+		globalKnownHostsFiles: splitKnownHostsFiles(endpoint.SshConfigGet("GlobalKnownHostsFile"), endpoint),
+
+		hashKnownHosts: isYes(endpoint.SshConfigGet("HashKnownHosts")),
+		checkHostIp:    isYes(endpoint.SshConfigGet("CheckHostIP")),
+	}
+}
+
+func splitKnownHostsFiles(value string, endpoint *ssh_endpoint.SshEndpoint) []string {
+	files := []string{}
+
+	for _, file := range strings.Fields(value) {
+		if strings.EqualFold(file, "none") {
+			return []string{}
+		}
+
+		files = append(files, ResolveSshConfigPath(file, endpoint))
+	}
+
+	return files
+}
+
+// getHostKeyCallbackForEndpoint builds a host key callback and the list of
+// preferred host key algorithms according to the endpoint's ssh_config.
+func getHostKeyCallbackForEndpoint(endpoint *ssh_endpoint.SshEndpoint) (ssh.HostKeyCallback, []string, error) {
+	policy := getHostKeyPolicyForEndpoint(endpoint)
+
+	existingFiles := []string{}
+	for _, file := range append(policy.userKnownHostsFiles, policy.globalKnownHostsFiles...) {
+		if _, err := os.Stat(file); err == nil {
+			existingFiles = append(existingFiles, file)
+		}
+	}
+
+	slog.Debug("Using known_hosts files", "files", existingFiles, "policy", policy.strictHostKeyChecking)
+
+	kh, err := knownhosts.NewDB(existingFiles...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostKeyCallback := ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		slog.Debug("Checking host key", "hostname", hostname, "remote", remote, "key", key)
+		err := kh.HostKeyCallback()(hostname, remote, key)
+
+		if knownhosts.IsHostKeyChanged(err) {
+			return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for host %s! This may indicate a MitM attack.", hostname)
+		}
+
+		if knownhosts.IsHostUnknown(err) {
+			if err := policy.confirmUnknownHost(hostname, remote, key); err != nil {
+				return err
+			}
+
+			return policy.addKnownHost([]string{hostname, remote.String()}, key)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if policy.checkHostIp {
+			policy.checkIp(kh, hostname, remote, key)
+		}
+
+		return nil
+	})
+
+	return hostKeyCallback, kh.HostKeyAlgorithms(fmt.Sprintf("%s:%s", endpoint.FinalHost(), endpoint.FinalPort())), nil
+}
+
+func (p *hostKeyPolicy) confirmUnknownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	switch p.strictHostKeyChecking {
+	case "yes":
+		return fmt.Errorf("No %s host key is known for %s and you have requested strict checking. Host key verification failed.", key.Type(), hostname)
+
+	case "accept-new", "no":
+		return nil
+	}
+
+	response, err := AskForInput(fmt.Sprintf(
+		"The authenticity of host '%s (%s)' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+		hostname, remote, key.Type(), ssh.FingerprintSHA256(key),
+	))
+	if err != nil {
+		return err
+	}
+
+	if string(response) != "yes" {
+		return fmt.Errorf("Host key verification failed.")
+	}
+
+	return nil
+}
+
+// checkIp warns if the remote IP address is recorded with a different key,
+// and records it if it isn't known yet.
+func (p *hostKeyPolicy) checkIp(kh *knownhosts.HostKeyDB, hostname string, remote net.Addr, key ssh.PublicKey) {
+	if _, isCert := key.(*ssh.Certificate); isCert {
+		return
+	}
+
+	if _, ok := remote.(*net.TCPAddr); !ok {
+		return
+	}
+
+	err := kh.HostKeyCallback()("", remote, key)
+
+	if knownhosts.IsHostKeyChanged(err) {
+		slog.Warn("The host key differs from the key for the IP address", "hostname", hostname, "remote", remote)
+		return
+	}
+
+	if knownhosts.IsHostUnknown(err) {
+		p.addKnownHost([]string{remote.String()}, key)
+	}
+}
+
+// addKnownHost appends the key to the first UserKnownHostsFile, hashing the
+// hostnames if HashKnownHosts is set.
+func (p *hostKeyPolicy) addKnownHost(addresses []string, key ssh.PublicKey) error {
+	if len(p.userKnownHostsFiles) == 0 {
+		slog.Warn("Not recording host key, UserKnownHostsFile is none", "addresses", addresses)
+		return nil
+	}
+
+	knownhostsPath := p.userKnownHostsFiles[0]
+
+	normalized := []string{}
+	for _, address := range addresses {
+		address = knownhosts.Normalize(address)
+
+		if address == "[0.0.0.0]:0" || strings.ContainsAny(address, "\t ") {
+			continue
+		}
+
+		if !p.checkHostIp && len(normalized) > 0 {
+			continue
+		}
+
+		if !slices.Contains(normalized, address) {
+			normalized = append(normalized, address)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return nil
+	}
+
+	lines := []string{}
+	if p.hashKnownHosts {
+		for _, address := range normalized {
+			lines = append(lines, knownhosts.Line([]string{xknownhosts.HashHostname(address)}, key))
+		}
+	} else {
+		lines = append(lines, knownhosts.Line(normalized, key))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(knownhostsPath), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(knownhostsPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Failed to add host to known_hosts", "path", knownhostsPath, "err", err)
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		slog.Error("Failed to add host to known_hosts", "path", knownhostsPath, "err", err)
+		return err
+	}
+
+	slog.Info("Added host to known_hosts", "addresses", normalized, "path", knownhostsPath)
+
+	return nil
+}
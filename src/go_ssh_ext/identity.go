@@ -0,0 +1,315 @@
+package go_ssh_ext
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+
+	"nvrh/src/ssh_endpoint"
+)
+
+// The identity files ssh tries when none are configured.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ecdsa_sk",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ed25519_sk",
+	"~/.ssh/id_xmss",
+	"~/.ssh/id_dsa",
+}
+
+// getSignersForEndpoint returns signers in the order ssh would offer them:
+// configured identities first (preferring the agent's copy of a key so no
+// passphrase is needed), each preceded by any certificate for it, then the
+// remaining agent keys unless IdentitiesOnly is set.
+func getSignersForEndpoint(endpoint *ssh_endpoint.SshEndpoint) ([]ssh.Signer, error) {
+	identitiesOnly := isYes(endpoint.SshConfigGet("IdentitiesOnly"))
+
+	agentSigners, _ := getSignersForIdentityAgent(endpoint)
+	certificates := getCertificatesForEndpoint(endpoint)
+
+	allSigners := []ssh.Signer{}
+	usedAgentKeys := map[string]bool{}
+
+	for _, identityFile := range getIdentityFilesForEndpoint(endpoint) {
+		signer := findAgentSigner(agentSigners, identityFile.publicKey)
+		if signer != nil {
+			slog.Info("Using identity from agent", "identityFile", identityFile.path)
+			usedAgentKeys[string(signer.PublicKey().Marshal())] = true
+		} else {
+			signer = identityFile.signer()
+			if signer == nil {
+				continue
+			}
+
+			slog.Info("Using identity file", "identityFile", identityFile.path)
+		}
+
+		candidates := append([]*ssh.Certificate{readCertificate(identityFile.path + "-cert.pub")}, certificates...)
+		allSigners = append(allSigners, certSignersFor(signer, candidates)...)
+		allSigners = append(allSigners, signer)
+	}
+
+	if !identitiesOnly {
+		for _, signer := range agentSigners {
+			if usedAgentKeys[string(signer.PublicKey().Marshal())] {
+				continue
+			}
+
+			allSigners = append(allSigners, certSignersFor(signer, certificates)...)
+			allSigners = append(allSigners, signer)
+		}
+	}
+
+	return allSigners, nil
+}
+
+type identityFile struct {
+	path       string
+	privateKey []byte
+	publicKey  ssh.PublicKey
+	encrypted  bool
+}
+
+// signer returns a signer for the identity file. For encrypted keys the
+// passphrase is only asked for when the server accepts the key and a
+// signature is actually needed.
+func (f *identityFile) signer() ssh.Signer {
+	if !f.encrypted {
+		signer, err := ssh.ParsePrivateKey(f.privateKey)
+		if err != nil {
+			slog.Error("Unable to parse private key", "identityFile", f.path, "err", err)
+			return nil
+		}
+
+		return signer
+	}
+
+	if f.publicKey == nil {
+		// Without a public key there's nothing to offer the server before
+		// asking for the passphrase.
+		signer, err := f.decrypt()
+		if err != nil {
+			slog.Error("Unable to parse private key", "identityFile", f.path, "err", err)
+			return nil
+		}
+
+		return signer
+	}
+
+	return &lazyIdentitySigner{file: f}
+}
+
+func (f *identityFile) decrypt() (ssh.Signer, error) {
+	var err error
+
+	for range 3 {
+		var passPhrase []byte
+		passPhrase, err = askForPassword(fmt.Sprintf("Enter passphrase for key '%s': ", f.path))
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(f.privateKey, passPhrase)
+		if err == nil {
+			return signer, nil
+		}
+	}
+
+	return nil, err
+}
+
+// getIdentityFilesForEndpoint reads every IdentityFile configured for the
+// endpoint, in order, falling back to the ssh defaults.
+func getIdentityFilesForEndpoint(endpoint *ssh_endpoint.SshEndpoint) []*identityFile {
+	paths := endpoint.SshConfigGetAll("IdentityFile")
+	if len(paths) == 0 || (len(paths) == 1 && paths[0] == ssh_config.Default("IdentityFile")) {
+		paths = defaultIdentityFiles
+	}
+
+	identityFiles := []*identityFile{}
+
+	for _, path := range paths {
+		// `ssh -G` lists the defaults too, so missing defaults aren't worth
+		// a warning.
+		isDefault := slices.Contains(defaultIdentityFiles, path)
+		path = ResolveSshConfigPath(path, endpoint)
+
+		if strings.EqualFold(path, "none") {
+			continue
+		}
+
+		privateKey, err := os.ReadFile(path)
+		if err != nil {
+			if isDefault {
+				slog.Debug("Default identity file not readable", "identityFile", path, "err", err)
+			} else {
+				slog.Warn("Identity file not readable", "identityFile", path, "err", err)
+			}
+
+			continue
+		}
+
+		f := &identityFile{
+			path:       path,
+			privateKey: privateKey,
+		}
+
+		if _, err := ssh.ParseRawPrivateKey(privateKey); err != nil {
+			if missingErr, ok := err.(*ssh.PassphraseMissingError); ok {
+				f.encrypted = true
+				f.publicKey = missingErr.PublicKey
+			} else {
+				slog.Error("Unable to parse private key", "identityFile", path, "err", err)
+				continue
+			}
+		} else if signer, err := ssh.ParsePrivateKey(privateKey); err == nil {
+			f.publicKey = signer.PublicKey()
+		}
+
+		if f.publicKey == nil {
+			f.publicKey = readPublicKey(path + ".pub")
+		}
+
+		identityFiles = append(identityFiles, f)
+	}
+
+	return identityFiles
+}
+
+// getCertificatesForEndpoint reads every CertificateFile configured for the
+// endpoint.
+func getCertificatesForEndpoint(endpoint *ssh_endpoint.SshEndpoint) []*ssh.Certificate {
+	certificates := []*ssh.Certificate{}
+
+	for _, path := range endpoint.SshConfigGetAll("CertificateFile") {
+		path = ResolveSshConfigPath(path, endpoint)
+		if strings.EqualFold(path, "none") {
+			continue
+		}
+
+		if cert := readCertificate(path); cert != nil {
+			certificates = append(certificates, cert)
+		} else {
+			slog.Warn("Certificate file not usable", "certificateFile", path)
+		}
+	}
+
+	return certificates
+}
+
+func readPublicKey(path string) ssh.PublicKey {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		slog.Warn("Unable to parse public key", "path", path, "err", err)
+		return nil
+	}
+
+	return key
+}
+
+func readCertificate(path string) *ssh.Certificate {
+	cert, ok := readPublicKey(path).(*ssh.Certificate)
+	if !ok {
+		return nil
+	}
+
+	return cert
+}
+
+// certSignersFor pairs a signer with every certificate issued for its key.
+func certSignersFor(signer ssh.Signer, certificates []*ssh.Certificate) []ssh.Signer {
+	certSigners := []ssh.Signer{}
+
+	for _, cert := range certificates {
+		if cert == nil || !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+			continue
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			slog.Warn("Unable to use certificate", "err", err)
+			continue
+		}
+
+		certSigners = append(certSigners, certSigner)
+	}
+
+	return certSigners
+}
+
+func findAgentSigner(agentSigners []ssh.Signer, publicKey ssh.PublicKey) ssh.Signer {
+	if publicKey == nil {
+		return nil
+	}
+
+	for _, signer := range agentSigners {
+		if bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+			return signer
+		}
+	}
+
+	return nil
+}
+
+// lazyIdentitySigner offers the public key of an encrypted identity file and
+// only decrypts it once a signature is requested.
+type lazyIdentitySigner struct {
+	file *identityFile
+
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+func (s *lazyIdentitySigner) load() (ssh.Signer, error) {
+	s.once.Do(func() {
+		s.signer, s.err = s.file.decrypt()
+		if s.err != nil {
+			slog.Error("Unable to parse private key", "identityFile", s.file.path, "err", s.err)
+		}
+	})
+
+	return s.signer, s.err
+}
+
+func (s *lazyIdentitySigner) PublicKey() ssh.PublicKey {
+	return s.file.publicKey
+}
+
+func (s *lazyIdentitySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.Sign(rand, data)
+}
+
+func (s *lazyIdentitySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok {
+		return algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	}
+
+	return signer.Sign(rand, data)
+}
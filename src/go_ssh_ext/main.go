@@ -1,16 +1,17 @@
 package go_ssh_ext
 
 import (
+	"bufio"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
-	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/kevinburke/ssh_config"
-	"github.com/skeema/knownhosts"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/term"
@@ -18,154 +19,273 @@ import (
 	"nvrh/src/ssh_endpoint"
 )
 
-func GetSshClientForEndpoint(endpoint *ssh_endpoint.SshEndpoint) (*ssh.Client, error) {
-	knownhostsPath := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+// GetSshClientForEndpoint connects to the endpoint, optionally through an
+// HTTP CONNECT or SOCKS5 proxy. See getProxyUrl for how `proxy` is used.
+func GetSshClientForEndpoint(endpoint *ssh_endpoint.SshEndpoint, proxy string) (*ssh.Client, error) {
+	hostKeyCallback, hostKeyAlgorithms, err := getHostKeyCallbackForEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := os.Stat(knownhostsPath); os.IsNotExist(err) {
-		f, ferr := os.Create(knownhostsPath)
-		os.OpenFile(knownhostsPath, os.O_CREATE|os.O_RDONLY, 0600)
-		if ferr != nil {
-			return nil, ferr
+	slog.Debug("Connecting to server", "endpoint", endpoint)
+
+	authMethods := getAuthMethodsForEndpoint(endpoint)
+
+	config := &ssh.ClientConfig{
+		User:              endpoint.FinalUser(),
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+	}
+
+	for _, key := range []string{"ProxyJump", "ProxyCommand"} {
+		if value := endpoint.SshConfigGet(key); value != "" && !strings.EqualFold(value, "none") {
+			slog.Warn("Option is not supported by the internal SSH client, use --ssh-path binary instead", "option", key, "value", value)
 		}
+	}
 
-		f.Close()
+	address := net.JoinHostPort(endpoint.FinalHost(), endpoint.FinalPort())
+
+	proxyUrl, err := getProxyUrl(proxy, address)
+	if err != nil {
+		return nil, err
 	}
 
-	kh, err := knownhosts.NewDB(knownhostsPath)
+	if connectTimeout, err := strconv.Atoi(endpoint.SshConfigGet("ConnectTimeout")); err == nil {
+		config.Timeout = time.Duration(connectTimeout) * time.Second
+	}
+
+	conn, err := dialWithProxy(proxyUrl, address, config.Timeout)
+	if err != nil {
+		slog.Error("Failed to dial", "err", err)
+		return nil, err
+	}
 
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
 	if err != nil {
+		conn.Close()
+		slog.Error("Failed to dial", "err", err)
 		return nil, err
 	}
 
-	hostKeyCallback := ssh.HostKeyCallback(func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		slog.Debug("Checking host key", "hostname", hostname, "remote", remote, "key", key)
-		err := kh.HostKeyCallback()(hostname, remote, key)
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	go keepAlive(client, endpoint)
+
+	return client, nil
+}
+
+// keepAlive implements ServerAliveInterval and ServerAliveCountMax, closing
+// the client when the server stops responding.
+func keepAlive(client *ssh.Client, endpoint *ssh_endpoint.SshEndpoint) {
+	interval, err := strconv.Atoi(endpoint.SshConfigGet("ServerAliveInterval"))
+	if err != nil || interval <= 0 {
+		return
+	}
+
+	countMax, err := strconv.Atoi(endpoint.SshConfigGet("ServerAliveCountMax"))
+	if err != nil || countMax < 1 {
+		countMax = 3
+	}
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
 
-		if knownhosts.IsHostKeyChanged(err) {
-			return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for host %s! This may indicate a MitM attack.", hostname)
+	missed := 0
+	for range ticker.C {
+		if sendKeepAlive(client, time.Duration(interval)*time.Second) {
+			missed = 0
+		} else {
+			missed++
 		}
 
-		if knownhosts.IsHostUnknown(err) {
-			fmt.Printf(`The authenticity of host '%s (%s)' can't be established.
-				%s key fingerprint is %s.
-				Are you sure you want to continue connecting (yes/no)? `,
-				hostname, remote, key.Type(), ssh.FingerprintSHA256(key),
-			)
-			var response string
-			fmt.Scanf("%v", &response)
-
-			if response != "yes" {
-				return fmt.Errorf("Host key verification failed.")
-			}
-
-			f, ferr := os.OpenFile(knownhostsPath, os.O_APPEND|os.O_WRONLY, 0600)
-			if ferr == nil {
-				defer f.Close()
-				ferr = knownhosts.WriteKnownHost(f, hostname, remote, key)
-			}
-			if ferr == nil {
-				slog.Info("Added host to known_hosts\n", "hostname", hostname)
-			} else {
-				slog.Error("Failed to add host to known_hosts\n", "hostname", hostname, "ferr", ferr)
-				return ferr
-			}
-
-			// permit previously-unknown hosts (warning: may be insecure)
-			return nil
+		if missed >= countMax {
+			slog.Warn("Server not responding, closing connection", "endpoint", endpoint)
+			client.Close()
+			return
 		}
+	}
+}
 
-		return err
-	})
+// sendKeepAlive reports whether the server replied to a keepalive within
+// timeout. A server that hangs never replies, so waiting on SendRequest alone
+// would never count it as missed.
+func sendKeepAlive(client *ssh.Client, timeout time.Duration) bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-replied:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
 
-	slog.Debug("Connecting to server", "endpoint", endpoint)
+// getAuthMethodsForEndpoint returns the supported auth methods in the order
+// given by PreferredAuthentications. Methods missing from that list are not
+// tried, just like ssh.
+func getAuthMethodsForEndpoint(endpoint *ssh_endpoint.SshEndpoint) []ssh.AuthMethod {
+	prompts, err := strconv.Atoi(endpoint.SshConfigGet("NumberOfPasswordPrompts"))
+	if err != nil || prompts < 1 {
+		prompts = 3
+	}
+
+	availableMethods := map[string]ssh.AuthMethod{
+		"publickey": ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return getSignersForEndpoint(endpoint)
+		}),
+
+		"keyboard-interactive": ssh.RetryableAuthMethod(
+			ssh.KeyboardInteractive(keyboardInteractiveChallenge),
+			prompts,
+		),
+
+		"password": ssh.RetryableAuthMethod(
+			ssh.PasswordCallback(func() (string, error) {
+				password, err := askForPassword(fmt.Sprintf("%s's password: ", endpoint))
+				if err != nil {
+					slog.Error("Error reading password", "err", err)
+					return "", err
+				}
+
+				return string(password), nil
+			}),
+			prompts,
+		),
+	}
 
 	authMethods := []ssh.AuthMethod{}
 
-	authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
-		allSigners := []ssh.Signer{}
+	for _, name := range strings.Split(endpoint.SshConfigGet("PreferredAuthentications"), ",") {
+		name = strings.TrimSpace(name)
 
-		if agentSigners, _ := getSignersForIdentityAgent(endpoint.GivenHost); agentSigners != nil {
-			allSigners = append(allSigners, agentSigners...)
+		if method, ok := availableMethods[name]; ok {
+			slog.Debug("Adding auth method", "method", name)
+			authMethods = append(authMethods, method)
+			delete(availableMethods, name)
 		}
+	}
 
-		if identitySigner, _ := getSignerForIdentityFile(endpoint.GivenHost); identitySigner != nil {
-			allSigners = append(allSigners, identitySigner)
-		}
+	return authMethods
+}
+
+// keyboardInteractiveChallenge renders server-provided prompts, used for
+// things like TOTP codes or Duo pushes.
+func keyboardInteractiveChallenge(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if name != "" {
+		fmt.Println(name)
+	}
+
+	if instruction != "" {
+		fmt.Println(instruction)
+	}
 
-		return allSigners, nil
-	}))
+	answers := make([]string, len(questions))
+
+	for i, question := range questions {
+		var answer []byte
+		var err error
+
+		if echos[i] {
+			answer, err = AskForInput(question)
+		} else {
+			answer, err = askForPassword(question)
+		}
 
-	authMethods = append(authMethods, ssh.PasswordCallback(func() (string, error) {
-		password, err := askForPassword(fmt.Sprintf("%s's password: ", endpoint))
 		if err != nil {
-			slog.Error("Error reading password", "err", err)
-			return "", err
+			slog.Error("Error reading answer", "err", err)
+			return nil, err
 		}
 
-		return string(password), nil
-	}))
+		answers[i] = string(answer)
+	}
 
-	config := &ssh.ClientConfig{
-		User:              endpoint.FinalUser(),
-		Auth:              authMethods,
-		HostKeyCallback:   hostKeyCallback,
-		HostKeyAlgorithms: kh.HostKeyAlgorithms(fmt.Sprintf("%s:%s", endpoint.FinalHost(), endpoint.FinalPort())),
+	return answers, nil
+}
+
+func getSignersForIdentityAgent(endpoint *ssh_endpoint.SshEndpoint) ([]ssh.Signer, error) {
+	sshAuthSock := getAgentSocketForEndpoint(endpoint)
+	if sshAuthSock == "" {
+		return nil, nil
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", endpoint.FinalHost(), endpoint.FinalPort()), config)
+	agentClient, err := connectToAgent(sshAuthSock)
 	if err != nil {
-		slog.Error("Failed to dial", "err", err)
 		return nil, err
 	}
 
-	return client, nil
-}
+	agentSigners, err := agentClient.Signers()
+	if err != nil {
+		slog.Error("Error getting signers from agent", "err", err)
+		return nil, err
+	}
 
-func getSignerForIdentityFile(hostname string) (ssh.Signer, error) {
-	identityFile := ssh_config.Get(hostname, "IdentityFile")
+	return agentSigners, nil
+}
 
-	if identityFile == "" {
+// GetForwardedAgentForEndpoint returns the agent that should be forwarded to
+// the endpoint, or nil if agent forwarding is disabled. ForwardAgent in
+// ssh_config can be `yes`, `no`, or the path to an agent socket. `given` is
+// the value asked for explicitly, and overrides ssh_config when it isn't nil.
+func GetForwardedAgentForEndpoint(endpoint *ssh_endpoint.SshEndpoint, given *bool) (agent.Agent, error) {
+	forwardAgent := endpoint.SshConfigGet("ForwardAgent")
+	if given != nil && !*given {
 		return nil, nil
 	}
+	force := given != nil && *given
+
+	var sshAuthSock string
+	switch strings.ToLower(forwardAgent) {
+	case "yes", "true":
+		sshAuthSock = getAgentSocketForEndpoint(endpoint)
+	case "no", "false", "":
+		if !force {
+			return nil, nil
+		}
 
-	identityFile = CleanupSshConfigValue(identityFile)
-
-	if _, err := os.Stat(identityFile); os.IsNotExist(err) {
-		slog.Error("Identity file does not exist", "identityFile", identityFile)
-		return nil, err
+		sshAuthSock = getAgentSocketForEndpoint(endpoint)
+	default:
+		if after, ok := strings.CutPrefix(forwardAgent, "$"); ok {
+			sshAuthSock = os.Getenv(after)
+		} else {
+			sshAuthSock = ResolveSshConfigPath(forwardAgent, endpoint)
+		}
 	}
 
-	slog.Info("Using identity file", "identityFile", identityFile)
+	if sshAuthSock == "" {
+		slog.Warn("Agent forwarding requested but no agent is available")
+		return nil, nil
+	}
 
-	key, err := os.ReadFile(identityFile)
+	agentClient, err := connectToAgent(sshAuthSock)
 	if err != nil {
-		slog.Error("Unable to read private key", "err", err)
 		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		if _, ok := err.(*ssh.PassphraseMissingError); ok {
-			passPhrase, _ := askForPassword(fmt.Sprintf("Enter passphrase for key '%s': ", identityFile))
+	return agentClient, nil
+}
 
-			signer, signerErr := ssh.ParsePrivateKeyWithPassphrase(key, passPhrase)
-			if signerErr != nil {
-				slog.Error("Unable to parse private key", "err", signerErr)
-				return nil, signerErr
-			}
+func getAgentSocketForEndpoint(endpoint *ssh_endpoint.SshEndpoint) string {
+	sshAuthSock := endpoint.SshConfigGet("IdentityAgent")
 
-			return signer, nil
-		}
-
-		slog.Error("Unable to parse private key", "err", err)
-		return nil, err
+	if strings.EqualFold(sshAuthSock, "none") {
+		return ""
 	}
 
-	return signer, nil
-}
+	if sshAuthSock == "SSH_AUTH_SOCK" {
+		sshAuthSock = ""
+	}
 
-func getSignersForIdentityAgent(hostname string) ([]ssh.Signer, error) {
-	sshAuthSock := ssh_config.Get(hostname, "IdentityAgent")
+	if after, ok := strings.CutPrefix(sshAuthSock, "$"); ok {
+		sshAuthSock = os.Getenv(after)
+	}
 
 	if sshAuthSock == "" {
 		sshAuthSock = os.Getenv("SSH_AUTH_SOCK")
@@ -176,11 +296,13 @@ func getSignersForIdentityAgent(hostname string) ([]ssh.Signer, error) {
 	}
 
 	if sshAuthSock == "" {
-		return nil, nil
+		return ""
 	}
 
-	sshAuthSock = CleanupSshConfigValue(sshAuthSock)
+	return ResolveSshConfigPath(sshAuthSock, endpoint)
+}
 
+func connectToAgent(sshAuthSock string) (agent.ExtendedAgent, error) {
 	conn, err := getConnectionForAgent(sshAuthSock)
 	if err != nil {
 		slog.Error("Failed to open SSH auth socket", "err", err)
@@ -188,14 +310,8 @@ func getSignersForIdentityAgent(hostname string) ([]ssh.Signer, error) {
 	}
 
 	slog.Info("Using ssh agent", "socket", sshAuthSock)
-	agentClient := agent.NewClient(conn)
-	agentSigners, err := agentClient.Signers()
-	if err != nil {
-		slog.Error("Error getting signers from agent", "err", err)
-		return nil, err
-	}
 
-	return agentSigners, nil
+	return agent.NewClient(conn), nil
 }
 
 func askForPassword(message string) ([]byte, error) {
@@ -209,3 +325,14 @@ func askForPassword(message string) ([]byte, error) {
 
 	return password, nil
 }
+
+func AskForInput(message string) ([]byte, error) {
+	fmt.Print(message)
+	input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strings.TrimRight(input, "\r\n")), nil
+}
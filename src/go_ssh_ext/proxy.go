@@ -0,0 +1,288 @@
+package go_ssh_ext
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getProxyUrl returns the proxy to connect to address through. An explicit
+// value wins, `none` disables proxying, otherwise ALL_PROXY / HTTPS_PROXY are
+// used unless NO_PROXY matches.
+func getProxyUrl(given string, address string) (*url.URL, error) {
+	raw := given
+
+	if strings.EqualFold(raw, "none") || strings.EqualFold(raw, "direct") {
+		return nil, nil
+	}
+
+	if raw == "" {
+		host, _, _ := net.SplitHostPort(address)
+		if matchesNoProxy(host) {
+			return nil, nil
+		}
+
+		raw = firstEnv("ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy")
+	}
+
+	if raw == "" {
+		return nil, nil
+	}
+
+	// Like curl, assume http:// when there is no scheme.
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	proxyUrl, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyUrl.Scheme)
+	}
+
+	return proxyUrl, nil
+}
+
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := strings.TrimSpace(os.Getenv(k)); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func matchesNoProxy(host string) bool {
+	noProxy := firstEnv("NO_PROXY", "no_proxy")
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), ".")
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialWithProxy opens a TCP connection to address, going through proxyUrl
+// when given.
+func dialWithProxy(proxyUrl *url.URL, address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if proxyUrl == nil {
+		return dialer.Dial("tcp", address)
+	}
+
+	slog.Info("Connecting through proxy", "proxy", proxyUrl.Redacted(), "address", address)
+
+	proxyAddress := proxyUrl.Host
+	if proxyUrl.Port() == "" {
+		switch proxyUrl.Scheme {
+		case "http":
+			proxyAddress = net.JoinHostPort(proxyUrl.Hostname(), "80")
+		case "https":
+			proxyAddress = net.JoinHostPort(proxyUrl.Hostname(), "443")
+		default:
+			proxyAddress = net.JoinHostPort(proxyUrl.Hostname(), "1080")
+		}
+	}
+
+	conn, err := dialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tunnel := conn
+	switch proxyUrl.Scheme {
+	case "https":
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+		tunnel, err = httpConnect(tlsConn, proxyUrl, address)
+	case "http":
+		tunnel, err = httpConnect(conn, proxyUrl, address)
+	default:
+		err = socks5Connect(conn, proxyUrl, address)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tunnel, nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel with the CONNECT method.
+func httpConnect(conn net.Conn, proxyUrl *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	// The SSH server sends its banner right away, so the reader may already
+	// hold some of it.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// socks5Connect performs a SOCKS5 handshake (RFC 1928), with username /
+// password authentication (RFC 1929) when the proxy URL has credentials.
+func socks5Connect(conn net.Conn, proxyUrl *url.URL, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{0x00}
+	if proxyUrl.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if proxyUrl.User == nil {
+			return fmt.Errorf("socks5 proxy requires authentication")
+		}
+
+		username := proxyUrl.User.Username()
+		password, _ := proxyUrl.User.Password()
+
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+
+		if reply[1] != 0x00 {
+			return fmt.Errorf("socks5 proxy authentication failed")
+		}
+	default:
+		return fmt.Errorf("socks5 proxy has no acceptable authentication method")
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, 0x01)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, 0x04)
+		request = append(request, ip.To16()...)
+	} else {
+		// Let the proxy resolve the hostname.
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks5 proxy refused connection to %s (code %d)", address, header[1])
+	}
+
+	// Skip the bound address and port.
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("socks5 proxy sent unknown address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
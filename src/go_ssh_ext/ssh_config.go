@@ -1,15 +1,19 @@
 package go_ssh_ext
 
 import (
+	"fmt"
 	"log/slog"
 	"os"
+	"os/user"
 	"strings"
+
+	"nvrh/src/ssh_endpoint"
 )
 
 func CleanupSshConfigValue(value string) string {
 	replaced := strings.Trim(value, "\"")
 
-	userHomeDir, err := os.UserHomeDir()
+	userHomeDir, err := UserHomeDir()
 	if err != nil {
 		slog.Warn("Error getting user home dir", "err", err)
 		return replaced
@@ -22,3 +26,82 @@ func CleanupSshConfigValue(value string) string {
 
 	return replaced
 }
+
+// UserHomeDir is like os.UserHomeDir, but falls back to the passwd entry
+// when $HOME is unset.
+func UserHomeDir() (string, error) {
+	if userHomeDir, err := os.UserHomeDir(); err == nil {
+		return userHomeDir, nil
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	if currentUser.HomeDir == "" {
+		return "", fmt.Errorf("no home directory for user %s", currentUser.Username)
+	}
+
+	return currentUser.HomeDir, nil
+}
+
+// ExpandSshConfigTokens replaces the `%` tokens documented in ssh_config(5),
+// which are allowed in keywords like IdentityFile, CertificateFile and
+// IdentityAgent.
+func ExpandSshConfigTokens(value string, endpoint *ssh_endpoint.SshEndpoint) string {
+	var b strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		switch value[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'd':
+			userHomeDir, _ := UserHomeDir()
+			b.WriteString(userHomeDir)
+		case 'h':
+			b.WriteString(endpoint.FinalHost())
+		case 'n':
+			b.WriteString(endpoint.GivenHost)
+		case 'p':
+			b.WriteString(endpoint.FinalPort())
+		case 'r':
+			b.WriteString(endpoint.FinalUser())
+		case 'u':
+			b.WriteString(endpoint.FallbackUser)
+		case 'i':
+			b.WriteString(fmt.Sprintf("%d", os.Getuid()))
+		case 'l', 'L':
+			hostname, _ := os.Hostname()
+			if value[i] == 'L' {
+				hostname, _, _ = strings.Cut(hostname, ".")
+			}
+			b.WriteString(hostname)
+		default:
+			// Unknown tokens are left untouched, like ssh does with unknown
+			// escapes it doesn't understand.
+			b.WriteByte('%')
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+// ResolveSshConfigPath expands tokens and cleans up a path-like value from
+// ssh_config.
+func ResolveSshConfigPath(value string, endpoint *ssh_endpoint.SshEndpoint) string {
+	return CleanupSshConfigValue(ExpandSshConfigTokens(value, endpoint))
+}
+
+// isYes reports whether a boolean ssh_config value is enabled. `ssh -G`
+// prints some of them as true / false.
+func isYes(value string) bool {
+	return strings.EqualFold(value, "yes") || strings.EqualFold(value, "true")
+}
@@ -0,0 +1,84 @@
+package local_clipboard
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// tool is a command that copies from stdin or pastes to stdout.
+type tool struct {
+	copy  []string
+	paste []string
+}
+
+func tools() []tool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []tool{{copy: []string{"pbcopy"}, paste: []string{"pbpaste"}}}
+
+	case "windows":
+		return []tool{{
+			copy:  []string{"powershell", "-NoProfile", "-Command", "[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())"},
+			paste: []string{"powershell", "-NoProfile", "-Command", "[Console]::OutputEncoding = [Text.Encoding]::UTF8; [Console]::Out.Write((Get-Clipboard -Raw))"},
+		}}
+
+	default:
+		var found []tool
+
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			found = append(found, tool{copy: []string{"wl-copy"}, paste: []string{"wl-paste", "--no-newline"}})
+		}
+
+		return append(
+			found,
+			tool{copy: []string{"xclip", "-selection", "clipboard"}, paste: []string{"xclip", "-selection", "clipboard", "-o"}},
+			tool{copy: []string{"xsel", "--clipboard", "--input"}, paste: []string{"xsel", "--clipboard", "--output"}},
+		)
+	}
+}
+
+func findTool() (*tool, error) {
+	for _, t := range tools() {
+		if _, err := exec.LookPath(t.copy[0]); err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no clipboard tool found, install wl-clipboard, xclip or xsel")
+}
+
+// Copy puts text on the clipboard.
+func Copy(text string) error {
+	t, err := findTool()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(t.copy[0], t.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+
+	return cmd.Run()
+}
+
+// Paste returns the text on the clipboard.
+func Paste() (string, error) {
+	t, err := findTool()
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(t.paste[0], t.paste[1:]...)
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	// Line endings are normalized, nvim has no use for \r.
+	return strings.ReplaceAll(stdout.String(), "\r\n", "\n"), nil
+}
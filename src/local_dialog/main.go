@@ -0,0 +1,62 @@
+package local_dialog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Confirm asks a yes/no question with a native dialog on this machine, with
+// button naming the action. It returns false without an error when the
+// answer is no.
+func Confirm(title string, message string, button string) (bool, error) {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command(
+			"osascript",
+			"-e", "on run argv",
+			"-e", `display dialog (item 2 of argv) with title (item 1 of argv) buttons {"Cancel", item 3 of argv} default button "Cancel"`,
+			"-e", "end run",
+			title,
+			message,
+			button,
+		)
+
+	case "windows":
+		// -Command doesn't take arguments, so they go through the environment.
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", windowsConfirmScript)
+		cmd.Env = append(os.Environ(), "NVRH_DIALOG_TITLE="+title, "NVRH_DIALOG_MESSAGE="+message)
+
+	default:
+		if _, err := exec.LookPath("zenity"); err == nil {
+			cmd = exec.Command("zenity", "--question", "--no-markup", "--title", title, "--text", message, "--ok-label", button, "--cancel-label", "Cancel")
+		} else if _, err := exec.LookPath("kdialog"); err == nil {
+			cmd = exec.Command("kdialog", "--title", title, "--yes-label", button, "--no-label", "Cancel", "--yesno", message)
+		} else {
+			return false, fmt.Errorf("no dialog tool found, install zenity or kdialog")
+		}
+	}
+
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+
+	// All of them exit with 1 for no.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+const windowsConfirmScript = `
+Add-Type -AssemblyName PresentationFramework
+$answer = [System.Windows.MessageBox]::Show($env:NVRH_DIALOG_MESSAGE, $env:NVRH_DIALOG_TITLE, 'YesNo', 'Question', 'No')
+if ($answer -eq 'Yes') { exit 0 } else { exit 1 }
+`
@@ -0,0 +1,69 @@
+package local_notify
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	LevelInfo  = "INFO"
+	LevelWarn  = "WARN"
+	LevelError = "ERROR"
+)
+
+// Show displays a desktop notification. level is one of the Level constants,
+// anything else is treated as LevelInfo.
+func Show(title string, message string, level string) error {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		// Passing the strings as arguments avoids escaping them for AppleScript.
+		cmd = exec.Command(
+			"osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title,
+			message,
+		)
+
+	case "windows":
+		// -Command doesn't take arguments, so they go through the environment.
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", windowsToastScript)
+		cmd.Env = append(os.Environ(), "NVRH_NOTIFY_TITLE="+title, "NVRH_NOTIFY_MESSAGE="+message)
+
+	default:
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return fmt.Errorf("notify-send not found, install libnotify")
+		}
+
+		urgency := "normal"
+		if level == LevelError {
+			urgency = "critical"
+		}
+
+		cmd = exec.Command("notify-send", "--app-name=nvrh", "--urgency="+urgency, title, message)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// windowsToastScript shows a toast through the WinRT API, attributed to
+// PowerShell since nvrh isn't a registered app.
+const windowsToastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] | Out-Null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $template.GetElementsByTagName('text')
+$text.Item(0).AppendChild($template.CreateTextNode($env:NVRH_NOTIFY_TITLE)) | Out-Null
+$text.Item(1).AppendChild($template.CreateTextNode($env:NVRH_NOTIFY_MESSAGE)) | Out-Null
+$appId = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($appId).Show([Windows.UI.Notifications.ToastNotification]::new($template))
+`
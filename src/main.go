@@ -38,6 +38,8 @@ func main() {
 
 		Commands: []*cli.Command{
 			&client.CliClientCommand,
+			&client.CliDoctorCommand,
+			&client.CliConfigCommand,
 		},
 	}
 
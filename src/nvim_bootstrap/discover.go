@@ -0,0 +1,93 @@
+package nvim_bootstrap
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Discovery is where nvim was found on the server.
+type Discovery struct {
+	Path string
+	// Via is how it was found, like "PATH", "login shell" or "cache".
+	Via string
+}
+
+// NvimCmd returns nvimCmd with nvim replaced by the one that was found.
+func (d *Discovery) NvimCmd(nvimCmd []string) []string {
+	if len(nvimCmd) == 0 {
+		return []string{d.Path}
+	}
+
+	return append([]string{d.Path}, nvimCmd[1:]...)
+}
+
+// rememberDiscovery saves where nvim was found for the next discovery on the
+// same host, or forgets it when it wasn't found.
+func rememberDiscovery(cache map[string]string, hostKey string, discovery *Discovery) {
+	if discovery == nil {
+		if _, ok := cache[hostKey]; ok {
+			delete(cache, hostKey)
+			saveDiscoveryCache(cache)
+		}
+
+		return
+	}
+
+	if cache[hostKey] != discovery.Path {
+		cache[hostKey] = discovery.Path
+		saveDiscoveryCache(cache)
+	}
+}
+
+func discoveryCachePath() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "nvrh", "nvim-paths.json"), nil
+}
+
+func loadDiscoveryCache() map[string]string {
+	cache := map[string]string{}
+
+	path, err := discoveryCachePath()
+	if err != nil {
+		return cache
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+
+	if err := json.Unmarshal(bytes, &cache); err != nil {
+		slog.Warn("Ignoring broken nvim path cache", "path", path, "err", err)
+		return map[string]string{}
+	}
+
+	return cache
+}
+
+func saveDiscoveryCache(cache map[string]string) {
+	path, err := discoveryCachePath()
+	if err != nil {
+		return
+	}
+
+	bytes, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Warn("Failed to save nvim path cache", "err", err)
+		return
+	}
+
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		slog.Warn("Failed to save nvim path cache", "err", err)
+	}
+}
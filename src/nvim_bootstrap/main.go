@@ -0,0 +1,424 @@
+package nvim_bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"nvrh/src/bridge_files"
+	"nvrh/src/go_ssh_ext"
+	"nvrh/src/nvim_helpers"
+	"nvrh/src/nvrh_base_ssh"
+)
+
+const (
+	ModeAsk    = "ask"
+	ModeAlways = "always"
+	ModeNever  = "never"
+)
+
+const (
+	probeTimeout  = 20 * time.Second
+	uploadTimeout = 10 * time.Minute
+)
+
+// Probe is what the shell-only probe found on the server. It can't use nvim,
+// since nvim may be missing.
+type Probe struct {
+	// Discovery is where nvim was found, or nil when it wasn't looked for or
+	// wasn't found.
+	Discovery    *Discovery
+	Os           string
+	Arch         string
+	CacheDir     string
+	Cached       bool
+	NvimVersion  *nvim_helpers.NvimVersion
+	VersionError string
+}
+
+// NvimPath is where a bootstrapped nvim lives on the server.
+func (p *Probe) NvimPath() string {
+	return p.CacheDir + "/bin/nvim"
+}
+
+// PrepareNvimCmd returns the nvim command to use on the server. With
+// discover, nvim is looked for beyond nvimCmd first, see RunProbe. Then, when
+// nvim is missing or older than nvim_helpers.MinimumNvimVersion, a release is
+// installed into a cache dir on the server, as mode allows. Both are answered
+// by a single probe.
+func PrepareNvimCmd(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	hostKey string,
+	nvimCmd []string,
+	candidates []string,
+	discover bool,
+	mode string,
+	version string,
+) ([]string, error) {
+	switch mode {
+	case ModeAsk, ModeAlways, ModeNever:
+	default:
+		return nil, fmt.Errorf("--bootstrap-nvim must be ask, always or never, got %q", mode)
+	}
+
+	if !discover && mode == ModeNever {
+		return nvimCmd, nil
+	}
+
+	probe, err := RunProbe(sshClient, hostKey, nvimCmd, candidates, discover, version)
+	if err != nil {
+		// Most likely a server without `sh`, like Windows. Carry on and let
+		// the usual steps report any problem with nvim.
+		slog.Debug("Skipping nvim discovery and bootstrap, probe failed", "err", err)
+		return nvimCmd, nil
+	}
+
+	if discover {
+		if probe.Discovery == nil {
+			slog.Warn("Could not find nvim on the server")
+		} else {
+			slog.Info("Found nvim", "path", probe.Discovery.Path, "via", probe.Discovery.Via)
+			nvimCmd = probe.Discovery.NvimCmd(nvimCmd)
+		}
+	}
+
+	if mode == ModeNever {
+		return nvimCmd, nil
+	}
+
+	return maybeBootstrap(sshClient, probe, nvimCmd, mode, version)
+}
+
+func maybeBootstrap(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	probe *Probe,
+	nvimCmd []string,
+	mode string,
+	version string,
+) ([]string, error) {
+	if probe.NvimVersion != nil && probe.NvimVersion.AtLeast(nvim_helpers.MinimumNvimVersion) {
+		return nvimCmd, nil
+	}
+
+	if probe.Cached {
+		slog.Info("Using bootstrapped nvim", "path", probe.NvimPath())
+		return []string{probe.NvimPath()}, nil
+	}
+
+	reason := "nvim was not found"
+	if probe.NvimVersion != nil {
+		reason = fmt.Sprintf(
+			"nvim %s is older than %s",
+			probe.NvimVersion,
+			nvim_helpers.MinimumNvimVersion,
+		)
+	}
+
+	asset, err := AssetName(probe.Os, probe.Arch)
+	if err != nil {
+		return nil, fmt.Errorf("%s on the server, and it can't be installed: %w", reason, err)
+	}
+
+	if mode == ModeAsk {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nvimCmd, nil
+		}
+
+		answer, err := go_ssh_ext.AskForInput(fmt.Sprintf(
+			"%s on the server. Install nvim %s into %s? (yes/no) ",
+			reason, version, probe.CacheDir,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.EqualFold(string(answer), "yes") && !strings.EqualFold(string(answer), "y") {
+			return nvimCmd, nil
+		}
+	}
+
+	tarball, err := LocalTarball(version, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Upload(sshClient, tarball, probe.CacheDir); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Bootstrapped nvim", "version", version, "path", probe.NvimPath())
+
+	return []string{probe.NvimPath()}, nil
+}
+
+// RunProbe runs the shell-only probe on the server. With discover, it also
+// looks for nvim: the candidates are tried first, then the path found for
+// this host last time if it's still there, then the PATH, then the PATH of a
+// login / interactive shell, then a list of well-known locations. The version
+// is that of the nvim found, or of nvimCmd otherwise.
+func RunProbe(
+	sshClient nvrh_base_ssh.BaseNvrhSshClient,
+	hostKey string,
+	nvimCmd []string,
+	candidates []string,
+	discover bool,
+	version string,
+) (*Probe, error) {
+	cache := map[string]string{}
+	if discover {
+		cache = loadDiscoveryCache()
+	}
+
+	quotedCandidates := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		quotedCandidates[i] = nvrh_base_ssh.ShellQuote(candidate)
+	}
+
+	quotedCached := ""
+	if cached := cache[hostKey]; cached != "" {
+		quotedCached = nvrh_base_ssh.ShellQuote(cached)
+	}
+
+	script := bridge_files.ReadFileWithTemplate("shell/nvim-probe.sh", map[string]any{
+		"Discover":   discover,
+		"Candidates": quotedCandidates,
+		"Cached":     quotedCached,
+		"Version":    nvrh_base_ssh.ShellQuote(version),
+		"NvimCmd":    strings.Join(nvimCmd, " "),
+	})
+
+	// The script goes over stdin, so it needs no quoting.
+	output, err := nvrh_base_ssh.RunWithInput(sshClient, "sh -s", strings.NewReader(script), probeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := &Discovery{}
+	sawFound := false
+	probe := &Probe{}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "found":
+			sawFound = true
+			discovery.Path = value
+		case "via":
+			discovery.Via = value
+		case "os":
+			probe.Os = value
+		case "arch":
+			probe.Arch = value
+		case "cache_dir":
+			probe.CacheDir = value
+		case "cached":
+			probe.Cached = value == "yes"
+		case "nvim_version":
+			if value != "" {
+				probe.NvimVersion, err = nvim_helpers.ParseNvimVersion(value)
+				if err != nil {
+					probe.VersionError = err.Error()
+				}
+			}
+		}
+	}
+
+	if probe.Os == "" || probe.CacheDir == "" || discover && !sawFound {
+		return nil, fmt.Errorf("unexpected probe output: %q", strings.TrimSpace(output))
+	}
+
+	if discover {
+		if discovery.Path != "" {
+			probe.Discovery = discovery
+		}
+		rememberDiscovery(cache, hostKey, probe.Discovery)
+	}
+
+	slog.Debug("Probed server for nvim", "probe", probe)
+
+	return probe, nil
+}
+
+// AssetName returns the name of the nvim release tarball for `uname -s` /
+// `uname -m` values.
+func AssetName(unameOs string, unameArch string) (string, error) {
+	var assetOs, assetArch string
+
+	switch strings.ToLower(unameOs) {
+	case "linux":
+		assetOs = "linux"
+	case "darwin":
+		assetOs = "macos"
+	default:
+		return "", fmt.Errorf("no nvim release for %s", unameOs)
+	}
+
+	switch strings.ToLower(unameArch) {
+	case "x86_64", "amd64":
+		assetArch = "x86_64"
+	case "aarch64", "arm64":
+		assetArch = "arm64"
+	default:
+		return "", fmt.Errorf("no nvim release for %s on %s", unameOs, unameArch)
+	}
+
+	return fmt.Sprintf("nvim-%s-%s.tar.gz", assetOs, assetArch), nil
+}
+
+// LocalCacheDir is where release tarballs are kept on this machine. Put a
+// tarball there by hand for servers without internet access.
+func LocalCacheDir(version string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cacheDir, "nvrh", "nvim", version), nil
+}
+
+// LocalTarball returns the path to a cached release tarball, downloading it
+// first if needed. Downloads are checked against the sha256 the release
+// publishes.
+func LocalTarball(version string, asset string) (string, error) {
+	cacheDir, err := LocalCacheDir(version)
+	if err != nil {
+		return "", err
+	}
+
+	tarballPath := filepath.Join(cacheDir, asset)
+	if _, err := os.Stat(tarballPath); err == nil {
+		return tarballPath, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	wantSha256, err := publishedSha256(version, asset)
+	if err != nil {
+		return "", err
+	}
+
+	url := releaseUrl(version, asset)
+	slog.Info("Downloading nvim", "url", url)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(cacheDir, asset+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if gotSha256 := hex.EncodeToString(hash.Sum(nil)); gotSha256 != wantSha256 {
+		return "", fmt.Errorf("downloading %s: sha256 is %s, the release publishes %s", url, gotSha256, wantSha256)
+	}
+
+	if err := os.Rename(tmp.Name(), tarballPath); err != nil {
+		return "", err
+	}
+
+	return tarballPath, nil
+}
+
+func releaseUrl(version string, name string) string {
+	return fmt.Sprintf("https://github.com/neovim/neovim/releases/download/%s/%s", version, name)
+}
+
+// publishedSha256 returns the sha256 a release publishes for one of its
+// assets. Newer releases list them all in shasum.txt, older ones have a
+// .sha256sum file per asset.
+func publishedSha256(version string, asset string) (string, error) {
+	for _, name := range []string{"shasum.txt", asset + ".sha256sum"} {
+		resp, err := http.Get(releaseUrl(version, name))
+		if err != nil {
+			return "", err
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("downloading %s: %s", releaseUrl(version, name), resp.Status)
+		}
+
+		// Lines look like `<sha256>  <asset>`, with a `*` before binary files.
+		for _, line := range strings.Split(string(body), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == asset {
+				return strings.ToLower(fields[0]), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("nvim %s doesn't publish a sha256 for %s", version, asset)
+}
+
+// Upload extracts a release tarball into dir on the server, over the SSH
+// connection.
+func Upload(sshClient nvrh_base_ssh.BaseNvrhSshClient, tarballPath string, dir string) error {
+	tarball, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+
+	slog.Info("Uploading nvim", "tarball", tarballPath, "dir", dir)
+
+	// Extract next to dir and only move it into place once that worked, so
+	// an interrupted upload never looks like a cached nvim to the probe.
+	output, err := nvrh_base_ssh.RunWithInput(
+		sshClient,
+		fmt.Sprintf(
+			`sh -c 'tmp="$0.partial.$$"; mkdir -p "$tmp" && tar -xzf - -C "$tmp" --strip-components=1 && rm -rf "$0" && mv "$tmp" "$0" && echo nvrh-bootstrap-ok; rm -rf "$tmp"' %s`,
+			nvrh_base_ssh.ShellQuote(dir),
+		),
+		tarball,
+		uploadTimeout,
+	)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(output, "nvrh-bootstrap-ok") {
+		return fmt.Errorf("extracting nvim on the server failed: %s", strings.TrimSpace(output))
+	}
+
+	return nil
+}
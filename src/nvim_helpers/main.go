@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -40,6 +42,21 @@ func WaitForNvim(ctx context.Context, ti *ssh_tunnel_info.SshTunnelInfo) (*nvim.
 	}
 }
 
+// NvimFromStream starts an RPC client over a stream, like one returned by
+// BaseNvrhSshClient.RunStdio.
+func NvimFromStream(stream io.ReadWriteCloser) (*nvim.Nvim, error) {
+	nv, err := nvim.New(stream, stream, stream, func(format string, args ...any) {
+		slog.Debug(fmt.Sprintf(format, args...))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go nv.Serve()
+
+	return nv, nil
+}
+
 func BuildRemoteCommandString(
 	nvimCmd []string,
 	shellName string,
@@ -52,7 +69,14 @@ func BuildRemoteCommandString(
 	if useEmbed {
 		headlessOrEmbed = "--embed"
 	}
-	nvimCmdWithAdditions := append(nvimCmd, headlessOrEmbed, "--listen", ti.RemoteBoundToIp())
+	var nvimCmdWithAdditions []string
+	if ti.Stdio {
+		// RPC goes over stdin / stdout, and --headless keeps nvim from waiting
+		// for a UI before nvrh has prepared it.
+		nvimCmdWithAdditions = append(nvimCmd, "--embed", "--headless")
+	} else {
+		nvimCmdWithAdditions = append(nvimCmd, headlessOrEmbed, "--listen", ti.RemoteBoundToIp())
+	}
 	nvimCmdQuoted := `"` + strings.Join(nvimCmdWithAdditions, `" "`) + `"`
 
 	switch shellName {
@@ -138,7 +162,12 @@ func BuildRemoteCommandString(
 			parts = append(parts, BuildRemoteEnvString(remoteEnv, shellName))
 		}
 
-		parts = append(parts, fmt.Sprintf(`start "" /WAIT %s`, nvimCmdQuoted))
+		if ti.Stdio {
+			// `start` would give nvim its own console instead of our stdio.
+			parts = append(parts, nvimCmdQuoted)
+		} else {
+			parts = append(parts, fmt.Sprintf(`start "" /WAIT %s`, nvimCmdQuoted))
+		}
 
 		return strings.Join(parts, "\n\n")
 	}
@@ -0,0 +1,73 @@
+package nvim_helpers
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type NvimVersion struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+}
+
+// MinimumNvimVersion is the oldest nvim the bridge code works with. It needs
+// `vim.uv`, `vim.base64` and `--remote-ui`.
+var MinimumNvimVersion = NvimVersion{Major: 0, Minor: 10, Patch: 0}
+
+var nvimVersionPattern = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+
+// ParseNvimVersion finds a version in strings like `NVIM v0.10.2` or
+// `0.11.0-dev-1234`.
+func ParseNvimVersion(s string) (*NvimVersion, error) {
+	match := nvimVersionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("no version in %q", s)
+	}
+
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+
+	return &NvimVersion{Major: major, Minor: minor, Patch: patch}, nil
+}
+
+func (v NvimVersion) AtLeast(other NvimVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+
+	return v.Patch >= other.Patch
+}
+
+func (v NvimVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// LocalNvimVersion returns the version of the local editor when it is nvim,
+// and nil for any other editor.
+func LocalNvimVersion(editor []string) (*NvimVersion, error) {
+	if len(editor) == 0 {
+		return nil, nil
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(editor[0])), ".exe")
+	if name != "nvim" {
+		return nil, nil
+	}
+
+	output, err := exec.Command(editor[0], "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseNvimVersion(string(output))
+}
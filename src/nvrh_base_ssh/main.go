@@ -1,11 +1,77 @@
 package nvrh_base_ssh
 
 import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
 	"nvrh/src/ssh_tunnel_info"
 )
 
 type BaseNvrhSshClient interface {
 	Run(command string, tunnelInfo *ssh_tunnel_info.SshTunnelInfo) error
+	// RunStdio starts a command and returns a stream connected to its stdin
+	// and stdout. Closing the stream stops the command.
+	RunStdio(command string) (io.ReadWriteCloser, error)
 	TunnelSocket(tunnelInfo *ssh_tunnel_info.SshTunnelInfo)
 	Close() error
 }
+
+// SftpOpener is implemented by clients that can start the SFTP subsystem on
+// the server.
+type SftpOpener interface {
+	OpenSftp() (io.ReadWriteCloser, error)
+}
+
+// ShellQuote quotes a string for a POSIX shell.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RunWithInput runs a command, feeds it input, and returns its output once the
+// command exits.
+func RunWithInput(
+	client BaseNvrhSshClient,
+	command string,
+	input io.Reader,
+	timeout time.Duration,
+) (string, error) {
+	stream, err := client.RunStdio(command)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	go func() {
+		if input != nil {
+			if _, err := io.Copy(stream, input); err != nil {
+				slog.Warn("Failed to send input", "err", err)
+			}
+		}
+
+		// Let the command see EOF on its stdin.
+		if closer, ok := stream.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+	}()
+
+	type result struct {
+		output []byte
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		output, err := io.ReadAll(stream)
+		done <- result{output, err}
+	}()
+
+	select {
+	case r := <-done:
+		return string(r.output), r.err
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out running %q", command)
+	}
+}
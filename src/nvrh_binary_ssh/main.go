@@ -2,11 +2,13 @@ package nvrh_binary_ssh
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 
 	"nvrh/src/context"
+	"nvrh/src/nvrh_local_ssh"
 	"nvrh/src/ssh_tunnel_info"
 )
 
@@ -57,6 +59,25 @@ func (c *NvrhBinarySshClient) Run(command string, tunnelInfo *ssh_tunnel_info.Ss
 	return nil
 }
 
+func (c *NvrhBinarySshClient) RunStdio(command string) (io.ReadWriteCloser, error) {
+	args := append([]string{c.SshPath}, c.SshArgs...)
+	// A tty would mangle the stream.
+	args = append(args, "-T", c.Ctx.Endpoint.Given, "--", command)
+
+	slog.Debug("Running command via SSH with stdio", "command", command)
+
+	return nvrh_local_ssh.DialCommand(args)
+}
+
+func (c *NvrhBinarySshClient) OpenSftp() (io.ReadWriteCloser, error) {
+	args := append([]string{c.SshPath}, c.SshArgs...)
+	args = append(args, "-T", "-s", c.Ctx.Endpoint.Given, "sftp")
+
+	slog.Debug("Starting SFTP via SSH")
+
+	return nvrh_local_ssh.DialCommand(args)
+}
+
 func (c *NvrhBinarySshClient) TunnelSocket(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) {
 	sshCommand := exec.Command(
 		c.SshPath,
@@ -0,0 +1,93 @@
+package nvrh_config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// Effective is the value an option ends up with, and where it came from.
+type Effective struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// Explain works out the value of every flag the way ApplyPrecedence would,
+// for a command run without arguments. host may be empty to only look at
+// `default`.
+func (cfg *NvrhConfig) Explain(flags []cli.Flag, host string, profile string) ([]Effective, error) {
+	layers, err := cfg.layers(host, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	effective := []Effective{}
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		docFlag, _ := flag.(cli.DocGenerationFlag)
+
+		result := Effective{Name: name}
+
+		// Env vars in the flag's own Sources are read while parsing, so they
+		// win over the config file.
+		if key, value, ok := lookupFlagEnv(docFlag); ok {
+			result.Value = value
+			result.Source = "$" + key
+		} else if source, value, ok := optionSource(layers, name); ok {
+			result.Value = formatValue(value)
+			result.Source = source
+		} else {
+			if docFlag != nil {
+				result.Value = docFlag.GetDefaultText()
+
+				// Single strings come quoted, unlike the other sources.
+				if unquoted, err := strconv.Unquote(result.Value); err == nil {
+					result.Value = unquoted
+				}
+			}
+			result.Source = "built-in default"
+		}
+
+		effective = append(effective, result)
+	}
+
+	return effective, nil
+}
+
+func lookupFlagEnv(flag cli.DocGenerationFlag) (string, string, bool) {
+	if flag == nil {
+		return "", "", false
+	}
+
+	for _, key := range flag.GetEnvVars() {
+		if value, ok := lookupFirst([]string{key}); ok {
+			return key, value, true
+		}
+	}
+
+	return "", "", false
+}
+
+func formatValue(value reflect.Value) string {
+	switch v := value.Interface().(type) {
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		return strings.Join(quoted, ", ")
+	case *bool:
+		return fmt.Sprintf("%v", *v)
+	case DirectConnectValue:
+		if v.Address != "" {
+			return v.Address
+		}
+		return "true"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
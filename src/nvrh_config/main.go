@@ -1,10 +1,12 @@
 package nvrh_config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"slices"
+	"reflect"
 	"strings"
 
 	"github.com/urfave/cli/v3"
@@ -33,32 +35,99 @@ func (dcv *DirectConnectValue) UnmarshalYAML(value *yaml.Node) error {
 		return nil
 	}
 
-	return fmt.Errorf("insecure-direct-connect must be a boolean or a string")
+	return fmt.Errorf("line %d: insecure-direct-connect must be a boolean or a string", value.Line)
 }
 
 type NvrhConfigServer struct {
+	// Extends names a server or profile to take unset options from.
+	Extends string `yaml:"extends,omitempty"`
+
 	NvimCmd       []string           `yaml:"nvim-cmd,omitempty"`
+	NvimCandidate []string           `yaml:"nvim-candidate,omitempty"`
 	UsePorts      *bool              `yaml:"use-ports,omitempty"`
 	SshArg        []string           `yaml:"ssh-arg,omitempty"`
 	SshPath       string             `yaml:"ssh-path,omitempty"`
 	LocalEditor   []string           `yaml:"local-editor,omitempty"`
+	OpenUrlCmd    []string           `yaml:"open-url-cmd,omitempty"`
 	ServerEnv     []string           `yaml:"server-env,omitempty"`
 	DirectConnect DirectConnectValue `yaml:"insecure-direct-connect,omitempty"`
 	UseNvimEmbed  *bool              `yaml:"use-nvim-embed,omitempty"`
+	UseStdio      *bool              `yaml:"use-stdio,omitempty"`
+	ForwardAgent  *bool              `yaml:"forward-agent,omitempty"`
+	Proxy         string             `yaml:"proxy,omitempty"`
+	DockerPath    string             `yaml:"docker-path,omitempty"`
+	DockerUser    string             `yaml:"docker-user,omitempty"`
+	KubectlPath   string             `yaml:"kubectl-path,omitempty"`
+	KubeContext   string             `yaml:"kube-context,omitempty"`
+
+	BootstrapNvim        string `yaml:"bootstrap-nvim,omitempty"`
+	BootstrapNvimVersion string `yaml:"bootstrap-nvim-version,omitempty"`
+
+	SyncConfig       string   `yaml:"sync-config,omitempty"`
+	SyncConfigIgnore []string `yaml:"sync-config-ignore,omitempty"`
+
+	OpenUrlScheme    []string `yaml:"open-url-scheme,omitempty"`
+	OpenUrlAllowHost []string `yaml:"open-url-allow-host,omitempty"`
+	OpenUrlDenyHost  []string `yaml:"open-url-deny-host,omitempty"`
+	OpenUrlConfirm   *bool    `yaml:"open-url-confirm,omitempty"`
+
+	Debug                *bool `yaml:"debug,omitempty"`
+	EnableAutomapPorts   *bool `yaml:"enable-automap-ports,omitempty"`
+	EnableClipboard      *bool `yaml:"enable-clipboard,omitempty"`
+	ForwardNotifications *bool `yaml:"forward-notifications,omitempty"`
 }
 
 type NvrhConfig struct {
-	Default NvrhConfigServer            `yaml:"default,omitempty"`
-	Servers map[string]NvrhConfigServer `yaml:"servers"`
+	Default  NvrhConfigServer            `yaml:"default,omitempty"`
+	Servers  map[string]NvrhConfigServer `yaml:"servers"`
+	Profiles map[string]NvrhConfigServer `yaml:"profiles,omitempty"`
+
+	serverOrder []string
 }
 
+// DefaultConfigPath is nvrh/config.yml in $XDG_CONFIG_HOME, or in ~/.config
+// when that isn't set. nvrh/config.yaml is used when only it exists.
 func DefaultConfigPath() string {
-	home, _ := os.UserHomeDir()
-	return filepath.Join(home, ".config", "nvrh", "config.yml")
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+
+	path := filepath.Join(dir, "nvrh", "config.yml")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		alternative := filepath.Join(dir, "nvrh", "config.yaml")
+		if _, err := os.Stat(alternative); err == nil {
+			return alternative
+		}
+	}
+
+	return path
+}
+
+// ConfigPath returns the path given with --config, or the default one.
+func ConfigPath(given string) string {
+	if given != "" {
+		return given
+	}
+
+	return DefaultConfigPath()
+}
+
+// Load loads the config file given with --config, which has to exist, or the
+// default one, which doesn't.
+func Load(given string) (*NvrhConfig, error) {
+	if given != "" {
+		if _, err := os.Stat(given); err != nil {
+			return nil, err
+		}
+	}
+
+	return LoadConfig(ConfigPath(given))
 }
 
 func LoadConfig(path string) (*NvrhConfig, error) {
-	bytes, err := os.ReadFile(path)
+	contents, err := os.ReadFile(path)
 
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -69,8 +138,18 @@ func LoadConfig(path string) (*NvrhConfig, error) {
 	}
 
 	var cconfig NvrhConfig
-	if err := yaml.Unmarshal(bytes, &cconfig); err != nil {
-		return nil, err
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+
+	// An empty file has no document at all.
+	if err := decoder.Decode(&cconfig); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid config file %s:\n  %s", path, describeDecodeError(err))
+	}
+
+	// Maps lose the order of the file, which decides which server entry wins.
+	var root yaml.Node
+	if err := yaml.Unmarshal(contents, &root); err == nil {
+		cconfig.serverOrder = serverOrder(&root)
 	}
 
 	if cconfig.Servers == nil {
@@ -82,44 +161,58 @@ func LoadConfig(path string) (*NvrhConfig, error) {
 
 var envIndex = map[string][]string{
 	"nvim-cmd":       {"NVRH_CLIENT_NVIM_CMD"},
+	"nvim-candidate": {"NVRH_CLIENT_NVIM_CANDIDATE"},
 	"use-ports":      {"NVRH_CLIENT_USE_PORTS"},
 	"ssh-arg":        {"NVRH_CLIENT_SSH_ARG"},
 	"ssh-path":       {"NVRH_CLIENT_SSH_PATH"},
 	"local-editor":   {"NVRH_CLIENT_LOCAL_EDITOR"},
+	"open-url-cmd":   {"NVRH_CLIENT_OPEN_URL_CMD"},
 	"server-env":     {"NVRH_CLIENT_SERVER_ENV"},
 	"use-nvim-embed": {"NVRH_CLIENT_USE_NVIM_EMBED"},
+	"use-stdio":      {"NVRH_CLIENT_USE_STDIO"},
+	"forward-agent":  {"NVRH_CLIENT_FORWARD_AGENT"},
+	"proxy":          {"NVRH_CLIENT_PROXY"},
+	"docker-path":    {"NVRH_CLIENT_DOCKER_PATH"},
+	"docker-user":    {"NVRH_CLIENT_DOCKER_USER"},
+	"kubectl-path":   {"NVRH_CLIENT_KUBECTL_PATH"},
+	"kube-context":   {"NVRH_CLIENT_KUBE_CONTEXT"},
+
+	"bootstrap-nvim":         {"NVRH_CLIENT_BOOTSTRAP_NVIM"},
+	"bootstrap-nvim-version": {"NVRH_CLIENT_BOOTSTRAP_NVIM_VERSION"},
+
+	"sync-config":        {"NVRH_CLIENT_SYNC_CONFIG"},
+	"sync-config-ignore": {"NVRH_CLIENT_SYNC_CONFIG_IGNORE"},
+
+	"open-url-scheme":     {"NVRH_CLIENT_OPEN_URL_SCHEME"},
+	"open-url-allow-host": {"NVRH_CLIENT_OPEN_URL_ALLOW_HOST"},
+	"open-url-deny-host":  {"NVRH_CLIENT_OPEN_URL_DENY_HOST"},
+	"open-url-confirm":    {"NVRH_CLIENT_OPEN_URL_CONFIRM"},
 }
 
-type shouldSetFunc func(name string) bool
-
+// ApplyPrecedence sets every flag that wasn't given, or read from its own env
+// vars, from serverConfig, then defaultServerConfig, then envIndex.
 func ApplyPrecedence(
 	c *cli.Command,
 	defaultServerConfig NvrhConfigServer,
 	serverConfig NvrhConfigServer,
 ) error {
-	flagNames := getFlagNames(c)
-	shouldSet := func(name string) bool {
-		return slices.Contains(flagNames, name) && !c.IsSet(name)
-	}
-
-	// First apply the specific server config, then the default config.
-	err := applyServerConfig(c, serverConfig, shouldSet)
-	if err != nil {
-		return err
+	layers := []configLayer{
+		{"servers", serverConfig},
+		{"default", defaultServerConfig},
 	}
 
-	err = applyServerConfig(c, defaultServerConfig, shouldSet)
-	if err != nil {
-		return err
-	}
-
-	// Fall back to environment variables if still not set.
-	for name, keys := range envIndex {
+	for _, f := range c.Flags {
+		name := f.Names()[0]
 		if c.IsSet(name) {
 			continue
 		}
 
-		if raw, ok := lookupFirst(keys); ok {
+		_, value, ok := optionSource(layers, name)
+		if !ok {
+			continue
+		}
+
+		for _, raw := range flagValues(value) {
 			if err := c.Set(name, raw); err != nil {
 				return err
 			}
@@ -129,80 +222,92 @@ func ApplyPrecedence(
 	return nil
 }
 
-func applyServerConfig(c *cli.Command, serverConfig NvrhConfigServer, shouldSet shouldSetFunc) error {
-	if shouldSet("ssh-path") && serverConfig.SshPath != "" {
-		if err := c.Set("ssh-path", serverConfig.SshPath); err != nil {
-			return err
-		}
-	}
-
-	if shouldSet("local-editor") && len(serverConfig.LocalEditor) > 0 {
-		for _, v := range serverConfig.LocalEditor {
-			if err := c.Set("local-editor", v); err != nil {
-				return err
+// optionSource returns the value of an option, and where it comes from: the
+// first layer that sets it, or else the first of its envIndex variables
+// that's set.
+func optionSource(layers []configLayer, name string) (string, reflect.Value, bool) {
+	if name != "extends" {
+		for _, layer := range layers {
+			if value, ok := layer.config.option(name); ok {
+				return layer.source, value, true
 			}
 		}
 	}
 
-	if shouldSet("server-env") && len(serverConfig.ServerEnv) > 0 {
-		for _, v := range serverConfig.ServerEnv {
-			if err := c.Set("server-env", v); err != nil {
-				return err
-			}
+	for _, key := range envIndex[name] {
+		if raw, ok := lookupFirst([]string{key}); ok {
+			return "$" + key, reflect.ValueOf(raw), true
 		}
 	}
 
-	if shouldSet("nvim-cmd") && len(serverConfig.NvimCmd) > 0 {
-		for _, v := range serverConfig.NvimCmd {
-			if err := c.Set("nvim-cmd", v); err != nil {
-				return err
-			}
-		}
-	}
+	return "", reflect.Value{}, false
+}
+
+// option returns the option with the given YAML name, if it's set.
+func (serverConfig NvrhConfigServer) option(name string) (reflect.Value, bool) {
+	value := reflect.ValueOf(serverConfig)
+	valueType := value.Type()
 
-	if shouldSet("use-ports") && serverConfig.UsePorts != nil {
-		if err := c.Set("use-ports", fmt.Sprintf("%v", *serverConfig.UsePorts)); err != nil {
-			return err
+	for i := 0; i < valueType.NumField(); i++ {
+		if optionName(valueType.Field(i)) != name {
+			continue
 		}
-	}
 
-	if shouldSet("ssh-arg") && len(serverConfig.SshArg) > 0 {
-		for _, v := range serverConfig.SshArg {
-			if err := c.Set("ssh-arg", v); err != nil {
-				return err
-			}
+		field := value.Field(i)
+		if field.IsZero() {
+			return reflect.Value{}, false
 		}
+
+		return field, true
 	}
 
-	if shouldSet("insecure-direct-connect") && serverConfig.DirectConnect.Enabled {
-		val := serverConfig.DirectConnect.Address
+	return reflect.Value{}, false
+}
 
-		if val == "" {
-			val = "true"
+// flagValues turns an option into what would be passed to its flag, once
+// per value for slices.
+func flagValues(field reflect.Value) []string {
+	switch v := field.Interface().(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case *bool:
+		return []string{fmt.Sprintf("%v", *v)}
+	case DirectConnectValue:
+		if !v.Enabled {
+			return nil
 		}
-
-		if err := c.Set("insecure-direct-connect", val); err != nil {
-			return err
+		if v.Address == "" {
+			return []string{"true"}
 		}
+		return []string{v.Address}
+	default:
+		panic(fmt.Sprintf("unsupported config option type %T", v))
 	}
+}
 
-	if shouldSet("use-nvim-embed") && serverConfig.UseNvimEmbed != nil {
-		if err := c.Set("use-nvim-embed", fmt.Sprintf("%v", *serverConfig.UseNvimEmbed)); err != nil {
-			return err
-		}
-	}
+// optionName returns the YAML key of a NvrhConfigServer field.
+func optionName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
 
-	return nil
+// OptionNames returns every key a server entry can have.
+func OptionNames() []string {
+	return yamlNames(reflect.TypeOf(NvrhConfigServer{}))
 }
 
-func getFlagNames(c *cli.Command) []string {
-	flagNames := []string{}
+func yamlNames(valueType reflect.Type) []string {
+	names := []string{}
 
-	for _, f := range c.Flags {
-		flagNames = append(flagNames, f.Names()...)
+	for i := 0; i < valueType.NumField(); i++ {
+		if name := optionName(valueType.Field(i)); name != "" {
+			names = append(names, name)
+		}
 	}
 
-	return flagNames
+	return names
 }
 
 func lookupFirst(keys []string) (string, bool) {
@@ -0,0 +1,535 @@
+package nvrh_config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+)
+
+func loadTestConfig(t *testing.T, contents string) *NvrhConfig {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+// runWithConfig runs a command with a few of the client's flags and returns
+// it after applying the config for host and profile.
+func runWithConfig(t *testing.T, cfg *NvrhConfig, host string, profile string, args ...string) *cli.Command {
+	t.Helper()
+
+	var applied *cli.Command
+	cmd := &cli.Command{
+		Name: "test",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "ssh-path", Value: "internal"},
+			&cli.StringSliceFlag{Name: "nvim-cmd", Value: []string{"nvim"}},
+			&cli.BoolFlag{Name: "use-ports"},
+			&cli.StringFlag{Name: "proxy"},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			applied = c
+
+			defaultConfig, serverConfig, err := cfg.Resolve(host, profile)
+			if err != nil {
+				return err
+			}
+
+			return ApplyPrecedence(c, defaultConfig, serverConfig)
+		},
+	}
+
+	if err := cmd.Run(context.Background(), append([]string{"test"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return applied
+}
+
+func TestMatchesHost(t *testing.T) {
+	tests := []struct {
+		key  string
+		host string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "other.com", false},
+		{"*", "example.com", true},
+		{"*.dev.example.com", "api.dev.example.com", true},
+		{"*.dev.example.com", "dev.example.com", false},
+		{"web-?", "web-1", true},
+		{"web-?", "web-10", false},
+		{"a.com b.com", "b.com", true},
+		{"*.dev.example.com !legacy.dev.example.com", "api.dev.example.com", true},
+		{"*.dev.example.com !legacy.dev.example.com", "legacy.dev.example.com", false},
+		{"!legacy.dev.example.com", "api.dev.example.com", false},
+		{"Example.COM", "example.com", true},
+		{"*.example.com", "API.Example.Com", true},
+		{"web-[12]", "web-1", false},
+		{"web-[12]", "web-[12]", true},
+		{`web-\*`, "web-1", false},
+		{`web-\*`, `web-\1`, true},
+		{"*", "docker://my-container", true},
+		{"docker://*", "docker://my-container", true},
+		{"k8s://staging/*", "k8s://staging/api-1", true},
+		{"*.prod", "docker://web.prod.internal", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"?", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesHost(tt.key, tt.host); got != tt.want {
+			t.Errorf("matchesHost(%q, %q) = %v, want %v", tt.key, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestServerConfigFirstMatchWins(t *testing.T) {
+	cfg := loadTestConfig(t, `
+servers:
+  api.dev.example.com:
+    ssh-path: binary
+  "*.dev.example.com !legacy.dev.example.com":
+    ssh-path: internal
+    proxy: socks5://bastion:1080
+  "*":
+    proxy: none
+    nvim-cmd:
+      - /opt/nvim/bin/nvim
+`)
+
+	tests := []struct {
+		host        string
+		wantSshPath string
+		wantProxy   string
+		wantNvimCmd []string
+	}{
+		{"api.dev.example.com", "binary", "socks5://bastion:1080", []string{"/opt/nvim/bin/nvim"}},
+		{"web.dev.example.com", "internal", "socks5://bastion:1080", []string{"/opt/nvim/bin/nvim"}},
+		{"legacy.dev.example.com", "", "none", []string{"/opt/nvim/bin/nvim"}},
+		{"elsewhere.com", "", "none", []string{"/opt/nvim/bin/nvim"}},
+	}
+
+	for _, tt := range tests {
+		got, err := cfg.ServerConfig(tt.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.SshPath != tt.wantSshPath {
+			t.Errorf("%s: ssh-path = %q, want %q", tt.host, got.SshPath, tt.wantSshPath)
+		}
+
+		if got.Proxy != tt.wantProxy {
+			t.Errorf("%s: proxy = %q, want %q", tt.host, got.Proxy, tt.wantProxy)
+		}
+
+		if !slices.Equal(got.NvimCmd, tt.wantNvimCmd) {
+			t.Errorf("%s: nvim-cmd = %v, want %v", tt.host, got.NvimCmd, tt.wantNvimCmd)
+		}
+	}
+}
+
+func TestServerConfigKeepsFileOrder(t *testing.T) {
+	// Enough entries that map order would shuffle them.
+	cfg := loadTestConfig(t, `
+servers:
+  "h?": {proxy: first}
+  "*": {proxy: last}
+  "h*": {proxy: third}
+  "?1": {proxy: fourth}
+  "h1": {proxy: fifth}
+`)
+
+	for range 20 {
+		got, err := cfg.ServerConfig("h1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Proxy != "first" {
+			t.Fatalf("proxy = %q, want %q", got.Proxy, "first")
+		}
+	}
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	cfg := loadTestConfig(t, `
+default:
+  ssh-path: binary
+  proxy: http://default:3128
+  use-ports: true
+
+servers:
+  "*.dev.example.com":
+    ssh-path: internal
+    nvim-cmd:
+      - /opt/nvim/bin/nvim
+`)
+
+	t.Setenv("NVRH_CLIENT_SSH_PATH", "from-env")
+	t.Setenv("NVRH_CLIENT_PROXY", "http://env:3128")
+	t.Setenv("NVRH_CLIENT_NVIM_CMD", "env-nvim")
+
+	t.Run("flag beats server", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "api.dev.example.com", "", "--ssh-path", "flag", "--nvim-cmd", "flag-nvim")
+
+		if got := c.String("ssh-path"); got != "flag" {
+			t.Errorf("ssh-path = %q, want %q", got, "flag")
+		}
+
+		if got := c.StringSlice("nvim-cmd"); !slices.Equal(got, []string{"flag-nvim"}) {
+			t.Errorf("nvim-cmd = %v, want [flag-nvim]", got)
+		}
+	})
+
+	t.Run("server beats default", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "api.dev.example.com", "")
+
+		if got := c.String("ssh-path"); got != "internal" {
+			t.Errorf("ssh-path = %q, want %q", got, "internal")
+		}
+
+		if got := c.StringSlice("nvim-cmd"); !slices.Equal(got, []string{"/opt/nvim/bin/nvim"}) {
+			t.Errorf("nvim-cmd = %v, want [/opt/nvim/bin/nvim]", got)
+		}
+	})
+
+	t.Run("default beats env", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "elsewhere.com", "")
+
+		if got := c.String("ssh-path"); got != "binary" {
+			t.Errorf("ssh-path = %q, want %q", got, "binary")
+		}
+
+		if got := c.String("proxy"); got != "http://default:3128" {
+			t.Errorf("proxy = %q, want %q", got, "http://default:3128")
+		}
+
+		if !c.Bool("use-ports") {
+			t.Errorf("use-ports = false, want true")
+		}
+	})
+
+	t.Run("env beats built-in default", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "elsewhere.com", "")
+
+		if got := c.StringSlice("nvim-cmd"); !slices.Equal(got, []string{"env-nvim"}) {
+			t.Errorf("nvim-cmd = %v, want [env-nvim]", got)
+		}
+	})
+
+	t.Run("built-in default", func(t *testing.T) {
+		c := runWithConfig(t, &NvrhConfig{}, "elsewhere.com", "")
+
+		if got := c.String("proxy"); got != "http://env:3128" {
+			t.Errorf("proxy = %q, want %q", got, "http://env:3128")
+		}
+
+		t.Setenv("NVRH_CLIENT_NVIM_CMD", "")
+		c = runWithConfig(t, &NvrhConfig{}, "elsewhere.com", "")
+
+		if got := c.StringSlice("nvim-cmd"); !slices.Equal(got, []string{"nvim"}) {
+			t.Errorf("nvim-cmd = %v, want [nvim]", got)
+		}
+	})
+}
+
+func TestProfilesAndExtends(t *testing.T) {
+	cfg := loadTestConfig(t, `
+default:
+  proxy: http://default:3128
+
+profiles:
+  binary:
+    ssh-path: binary
+  gui:
+    extends: binary
+    local-editor:
+      - nvim-qt
+      - --server
+      - "{{SOCKET_PATH}}"
+
+servers:
+  base.example.com:
+    ssh-path: internal
+    nvim-cmd:
+      - /opt/nvim/bin/nvim
+  child.example.com:
+    extends: base.example.com
+    proxy: none
+  via-profile.example.com:
+    extends: binary
+`)
+
+	t.Run("extends a server", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "child.example.com", "")
+
+		if got := c.String("ssh-path"); got != "internal" {
+			t.Errorf("ssh-path = %q, want %q", got, "internal")
+		}
+
+		if got := c.StringSlice("nvim-cmd"); !slices.Equal(got, []string{"/opt/nvim/bin/nvim"}) {
+			t.Errorf("nvim-cmd = %v, want [/opt/nvim/bin/nvim]", got)
+		}
+
+		if got := c.String("proxy"); got != "none" {
+			t.Errorf("proxy = %q, want %q", got, "none")
+		}
+	})
+
+	t.Run("extends a profile", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "via-profile.example.com", "")
+
+		if got := c.String("ssh-path"); got != "binary" {
+			t.Errorf("ssh-path = %q, want %q", got, "binary")
+		}
+	})
+
+	t.Run("profile beats server", func(t *testing.T) {
+		_, serverConfig, err := cfg.Resolve("child.example.com", "gui")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if serverConfig.SshPath != "binary" {
+			t.Errorf("ssh-path = %q, want %q", serverConfig.SshPath, "binary")
+		}
+
+		if !slices.Equal(serverConfig.LocalEditor, []string{"nvim-qt", "--server", "{{SOCKET_PATH}}"}) {
+			t.Errorf("local-editor = %v", serverConfig.LocalEditor)
+		}
+
+		if serverConfig.Proxy != "none" {
+			t.Errorf("proxy = %q, want %q", serverConfig.Proxy, "none")
+		}
+	})
+
+	t.Run("flag beats profile", func(t *testing.T) {
+		c := runWithConfig(t, cfg, "child.example.com", "gui", "--ssh-path", "flag")
+
+		if got := c.String("ssh-path"); got != "flag" {
+			t.Errorf("ssh-path = %q, want %q", got, "flag")
+		}
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		if _, _, err := cfg.Resolve("child.example.com", "nope"); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestExtendsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"cycle", `
+servers:
+  a.example.com:
+    extends: b.example.com
+  b.example.com:
+    extends: a.example.com
+`},
+		{"self", `
+profiles:
+  loop:
+    extends: loop
+servers:
+  a.example.com:
+    extends: loop
+`},
+		{"unknown", `
+servers:
+  a.example.com:
+    extends: missing
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.config)
+			if _, _, err := cfg.Resolve("a.example.com", ""); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestApplyPrecedenceReadsEveryEnvVar(t *testing.T) {
+	for name, keys := range envIndex {
+		for _, key := range keys {
+			t.Run(key, func(t *testing.T) {
+				t.Setenv(key, "from-env")
+
+				var applied *cli.Command
+				cmd := &cli.Command{
+					Name:  "test",
+					Flags: []cli.Flag{&cli.StringFlag{Name: name}},
+					Action: func(ctx context.Context, c *cli.Command) error {
+						applied = c
+						return ApplyPrecedence(c, NvrhConfigServer{}, NvrhConfigServer{})
+					},
+				}
+
+				if err := cmd.Run(context.Background(), []string{"test"}); err != nil {
+					t.Fatal(err)
+				}
+				if got := applied.String(name); got != "from-env" {
+					t.Errorf("%s = %q, want %q", name, got, "from-env")
+				}
+
+				if err := cmd.Run(context.Background(), []string{"test", "--" + name, "from-flag"}); err != nil {
+					t.Fatal(err)
+				}
+				if got := applied.String(name); got != "from-flag" {
+					t.Errorf("%s = %q, want %q", name, got, "from-flag")
+				}
+			})
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	cfg := loadTestConfig(t, `
+default:
+  ssh-path: binary
+
+profiles:
+  gui:
+    local-editor:
+      - nvim-qt
+
+servers:
+  "*.dev.example.com":
+    nvim-cmd:
+      - /opt/nvim/bin/nvim
+`)
+
+	t.Setenv("NVRH_CLIENT_PROXY", "none")
+	t.Setenv("NVRH_CLIENT_DEBUG", "true")
+
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "ssh-path", Value: "internal"},
+		&cli.StringSliceFlag{Name: "nvim-cmd", Value: []string{"nvim"}},
+		&cli.StringSliceFlag{Name: "local-editor"},
+		&cli.StringFlag{Name: "proxy"},
+		&cli.StringFlag{Name: "docker-path", Value: "docker"},
+		&cli.BoolFlag{Name: "debug", Sources: cli.EnvVars("NVRH_CLIENT_DEBUG")},
+	}
+
+	effective, err := cfg.Explain(flags, "api.dev.example.com", "gui")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Effective{
+		{"ssh-path", "binary", "default"},
+		{"nvim-cmd", `"/opt/nvim/bin/nvim"`, "servers: *.dev.example.com"},
+		{"local-editor", `"nvim-qt"`, "profiles: gui"},
+		{"proxy", "none", "$NVRH_CLIENT_PROXY"},
+		{"docker-path", "docker", "built-in default"},
+		{"debug", "true", "$NVRH_CLIENT_DEBUG"},
+	}
+
+	if !slices.Equal(effective, want) {
+		t.Errorf("Explain() = %v, want %v", effective, want)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	contents := `
+default:
+  ssh-args:
+    - -v
+  use_ports: true
+serverz: {}
+servers:
+  a.example.com:
+    proxyy: none
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{
+		`line 3: unknown option "ssh-args", did you mean "ssh-arg"?`,
+		`line 5: unknown option "use_ports", did you mean "use-ports"?`,
+		`line 6: unknown section "serverz", did you mean "servers"?`,
+		`line 9: unknown option "proxyy", did you mean "proxy"?`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %q:\n%s", want, err)
+		}
+	}
+}
+
+func TestApplyPrecedenceSetsEveryOption(t *testing.T) {
+	cfg := loadTestConfig(t, `
+default:
+  debug: true
+  insecure-direct-connect: true
+  local-editor:
+    - nvim-qt
+servers:
+  a.example.com:
+    insecure-direct-connect: 10.0.0.1
+`)
+
+	var applied *cli.Command
+	cmd := &cli.Command{
+		Name: "test",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{Name: "debug"},
+			&cli.StringFlag{Name: "insecure-direct-connect"},
+			&cli.StringSliceFlag{Name: "local-editor"},
+		},
+		Action: func(ctx context.Context, c *cli.Command) error {
+			applied = c
+
+			defaultConfig, serverConfig, err := cfg.Resolve("a.example.com", "")
+			if err != nil {
+				return err
+			}
+
+			return ApplyPrecedence(c, defaultConfig, serverConfig)
+		},
+	}
+
+	if err := cmd.Run(context.Background(), []string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !applied.Bool("debug") {
+		t.Error("debug = false, want true")
+	}
+
+	if got := applied.String("insecure-direct-connect"); got != "10.0.0.1" {
+		t.Errorf("insecure-direct-connect = %q, want %q", got, "10.0.0.1")
+	}
+
+	if got := applied.StringSlice("local-editor"); !slices.Equal(got, []string{"nvim-qt"}) {
+		t.Errorf("local-editor = %v, want [nvim-qt]", got)
+	}
+}
@@ -0,0 +1,50 @@
+package nvrh_config_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/urfave/cli/v3"
+
+	"nvrh/src/client"
+	"nvrh/src/nvrh_config"
+)
+
+func TestEveryFlagIsAnOption(t *testing.T) {
+	options := nvrh_config.OptionNames()
+
+	for _, flag := range client.ClientFlags() {
+		if name := flag.Names()[0]; !slices.Contains(options, name) {
+			t.Errorf("--%s can't be set in the config file", name)
+		}
+	}
+}
+
+// Every command that prepares the remote nvim, including reconnect, needs the
+// flags that shape the bridge.
+func TestSessionCommandsTakeTheBridgeFlags(t *testing.T) {
+	bridgeFlags := []string{
+		"enable-clipboard",
+		"forward-notifications",
+		"open-url-cmd",
+		"open-url-scheme",
+		"open-url-allow-host",
+		"open-url-deny-host",
+		"open-url-confirm",
+	}
+
+	for _, command := range []*cli.Command{
+		&client.CliClientOpenCommand,
+		&client.CliClientFromNeovimCommand,
+		&client.CliClientReconnectCommand,
+	} {
+		for _, name := range bridgeFlags {
+			hasFlag := slices.ContainsFunc(command.Flags, func(flag cli.Flag) bool {
+				return slices.Contains(flag.Names(), name)
+			})
+			if !hasFlag {
+				t.Errorf("%s doesn't take --%s", command.Name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package nvrh_config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serverOrder returns the keys of `servers` in a parsed config file, in the
+// order they're written.
+func serverOrder(root *yaml.Node) []string {
+	doc := root
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+
+	order := []string{}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value != "servers" || doc.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+
+		servers := doc.Content[i+1]
+		for j := 0; j+1 < len(servers.Content); j += 2 {
+			order = append(order, servers.Content[j].Value)
+		}
+	}
+
+	return order
+}
+
+// configLayer is one place a host's options come from, like a profile or an
+// entry in `servers`, with every `extends` followed.
+type configLayer struct {
+	source string
+	config NvrhConfigServer
+}
+
+// layers returns where a host's options come from, the first one to set an
+// option winning: profile when it isn't empty, every entry in `servers` the
+// host matches, then `default`. host may be empty to leave out `servers`.
+func (cfg *NvrhConfig) layers(host string, profile string) ([]configLayer, error) {
+	layers := []configLayer{}
+
+	if profile != "" {
+		profileConfig, ok := cfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", profile)
+		}
+
+		profileConfig, err := cfg.resolveExtends(profileConfig, []string{profile})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{fmt.Sprintf("profiles: %s", profile), profileConfig})
+	}
+
+	if host != "" {
+		serverLayers, err := cfg.serverLayers(host)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, serverLayers...)
+	}
+
+	defaultConfig, err := cfg.resolveExtends(cfg.Default, []string{"default"})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(layers, configLayer{"default", defaultConfig}), nil
+}
+
+// serverLayers returns every entry in `servers` a host matches, in file
+// order.
+func (cfg *NvrhConfig) serverLayers(host string) ([]configLayer, error) {
+	layers := []configLayer{}
+
+	for _, key := range cfg.orderedServerKeys() {
+		if !matchesHost(key, host) {
+			continue
+		}
+
+		resolved, err := cfg.resolveExtends(cfg.Servers[key], []string{key})
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, configLayer{fmt.Sprintf("servers: %s", key), resolved})
+	}
+
+	return layers, nil
+}
+
+// Resolve returns the default settings, and the settings for a host with
+// profile applied on top when it isn't empty, with every `extends` followed.
+func (cfg *NvrhConfig) Resolve(host string, profile string) (NvrhConfigServer, NvrhConfigServer, error) {
+	layers, err := cfg.layers(host, profile)
+	if err != nil {
+		return NvrhConfigServer{}, NvrhConfigServer{}, err
+	}
+
+	var serverConfig NvrhConfigServer
+	for _, layer := range layers[:len(layers)-1] {
+		mergeServerConfig(&serverConfig, layer.config)
+	}
+
+	return layers[len(layers)-1].config, serverConfig, nil
+}
+
+// ServerConfig returns the settings for a host from every entry in `servers`
+// it matches. Like ssh_config, keys are space separated patterns using `*`,
+// `?` and `!` for negation, and the first entry in the file to set an option
+// wins.
+func (cfg *NvrhConfig) ServerConfig(host string) (NvrhConfigServer, error) {
+	layers, err := cfg.serverLayers(host)
+	if err != nil {
+		return NvrhConfigServer{}, err
+	}
+
+	var merged NvrhConfigServer
+	for _, layer := range layers {
+		mergeServerConfig(&merged, layer.config)
+	}
+
+	return merged, nil
+}
+
+// resolveExtends fills in the options an entry doesn't set from the server
+// or profile it extends, looking at servers first. chain is the names
+// followed so far, to catch cycles.
+func (cfg *NvrhConfig) resolveExtends(entry NvrhConfigServer, chain []string) (NvrhConfigServer, error) {
+	name := entry.Extends
+	if name == "" {
+		return entry, nil
+	}
+
+	chain = append(chain, name)
+	if slices.Contains(chain[:len(chain)-1], name) {
+		return NvrhConfigServer{}, fmt.Errorf("extends cycle: %s", strings.Join(chain, " -> "))
+	}
+
+	base, ok := cfg.Servers[name]
+	if !ok {
+		base, ok = cfg.Profiles[name]
+	}
+	if !ok {
+		return NvrhConfigServer{}, fmt.Errorf("%s extends unknown server or profile %q", chain[len(chain)-2], name)
+	}
+
+	base, err := cfg.resolveExtends(base, chain)
+	if err != nil {
+		return NvrhConfigServer{}, err
+	}
+
+	entry.Extends = ""
+	mergeServerConfig(&entry, base)
+
+	return entry, nil
+}
+
+// orderedServerKeys returns the keys of Servers in file order, followed by
+// any that weren't read from a file.
+func (cfg *NvrhConfig) orderedServerKeys() []string {
+	keys := []string{}
+	seen := map[string]bool{}
+
+	for _, key := range cfg.serverOrder {
+		if _, ok := cfg.Servers[key]; ok && !seen[key] {
+			keys = append(keys, key)
+			seen[key] = true
+		}
+	}
+
+	for key := range cfg.Servers {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// matchesHost reports whether host matches any of the patterns in key and
+// none of its negated ones. Like ssh, hosts match case-insensitively.
+func matchesHost(key string, host string) bool {
+	matched := false
+
+	for _, pattern := range strings.Fields(key) {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if !matchPattern(strings.ToLower(pattern), strings.ToLower(host)) {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+// matchPattern matches like ssh_config, where `*` is any run of characters,
+// `?` is one, and everything else is literal.
+func matchPattern(pattern string, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchPattern(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// mergeServerConfig sets the options of dst that are still unset from src.
+func mergeServerConfig(dst *NvrhConfigServer, src NvrhConfigServer) {
+	dstValue := reflect.ValueOf(dst).Elem()
+	srcValue := reflect.ValueOf(src)
+
+	for i := 0; i < dstValue.NumField(); i++ {
+		if dstValue.Field(i).IsZero() {
+			dstValue.Field(i).Set(srcValue.Field(i))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package nvrh_config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var unknownFieldPattern = regexp.MustCompile(`^line (\d+): field (.+) not found in type (\S+)$`)
+
+// describeDecodeError lists the problems found by decoding, suggesting the
+// closest name for keys it didn't know.
+func describeDecodeError(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err.Error()
+	}
+
+	problems := []string{}
+	for _, problem := range typeErr.Errors {
+		match := unknownFieldPattern.FindStringSubmatch(problem)
+
+		switch {
+		case match == nil:
+			problems = append(problems, problem)
+		case match[3] == reflect.TypeOf(NvrhConfig{}).String():
+			sections := yamlNames(reflect.TypeOf(NvrhConfig{}))
+			problems = append(problems, fmt.Sprintf("line %s: unknown section %q%s", match[1], match[2], suggest(match[2], sections)))
+		default:
+			problems = append(problems, fmt.Sprintf("line %s: unknown option %q%s", match[1], match[2], suggest(match[2], OptionNames())))
+		}
+	}
+
+	return strings.Join(problems, "\n  ")
+}
+
+// suggest returns a hint naming the candidate closest to a misspelled name,
+// or nothing if none is close.
+func suggest(name string, candidates []string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+
+	best := ""
+	bestDistance := 3
+	for _, candidate := range candidates {
+		if distance := levenshtein(normalized, candidate); distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+
+	if best == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(", did you mean %q?", best)
+}
+
+func levenshtein(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous = current
+	}
+
+	return previous[len(b)]
+}
+
+// Validate follows every `extends` in the file, reporting the ones that name
+// something unknown or loop.
+func (cfg *NvrhConfig) Validate() error {
+	problems := []string{}
+
+	if _, err := cfg.resolveExtends(cfg.Default, []string{"default"}); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, key := range cfg.orderedServerKeys() {
+		if _, err := cfg.resolveExtends(cfg.Servers[key], []string{key}); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	for name, profile := range cfg.Profiles {
+		if _, err := cfg.resolveExtends(profile, []string{name}); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return fmt.Errorf("%s", strings.Join(slices.Compact(problems), "\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package nvrh_docker_ssh
+
+import (
+	"net"
+
+	"nvrh/src/context"
+	"nvrh/src/nvrh_local_ssh"
+	"nvrh/src/ssh_tunnel_info"
+)
+
+// NvrhDockerSshClient runs nvim in a container with `docker exec`. Sockets
+// and ports are relayed over the stdio of another `docker exec`, so the
+// container doesn't need any published ports.
+type NvrhDockerSshClient struct {
+	nvrh_local_ssh.NvrhLocalSshClient
+
+	DockerPath string
+	Container  string
+	User       string
+}
+
+func NewNvrhDockerSshClient(
+	ctx *context.NvrhContext,
+	dockerPath string,
+	container string,
+	user string,
+) *NvrhDockerSshClient {
+	c := &NvrhDockerSshClient{
+		DockerPath: dockerPath,
+		Container:  container,
+		User:       user,
+	}
+
+	c.Ctx = ctx
+	c.WrapCommand = c.wrapCommand
+	c.DialRemote = c.dialRemote
+
+	return c
+}
+
+func (c *NvrhDockerSshClient) execArgs() []string {
+	// Keep stdin open for relays and RunStdio.
+	args := []string{c.DockerPath, "exec", "-i"}
+
+	if c.User != "" {
+		args = append(args, "-u", c.User)
+	}
+
+	return append(args, c.Container)
+}
+
+func (c *NvrhDockerSshClient) wrapCommand(command string) []string {
+	return nvrh_local_ssh.ExecShellCommand(c.execArgs(), command)
+}
+
+func (c *NvrhDockerSshClient) dialRemote(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) (net.Conn, error) {
+	return nvrh_local_ssh.DialCommand(append(
+		c.execArgs(),
+		nvrh_local_ssh.RelayCommand(c.Ctx.NvimCmd, tunnelInfo)...,
+	))
+}
@@ -6,8 +6,10 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"sync"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 
 	"nvrh/src/context"
 	"nvrh/src/ssh_tunnel_info"
@@ -16,6 +18,11 @@ import (
 type NvrhInternalSshClient struct {
 	Ctx       *context.NvrhContext
 	SshClient *ssh.Client
+
+	// Agent is forwarded to every session when set.
+	Agent agent.Agent
+
+	forwardAgentOnce sync.Once
 }
 
 func (c *NvrhInternalSshClient) Close() error {
@@ -37,7 +44,7 @@ func (c *NvrhInternalSshClient) Run(command string, tunnelInfo *ssh_tunnel_info.
 		go c.TunnelSocket(tunnelInfo)
 	}
 
-	session, err := c.SshClient.NewSession()
+	session, err := c.newSession()
 
 	if err != nil {
 		return err
@@ -57,6 +64,119 @@ func (c *NvrhInternalSshClient) Run(command string, tunnelInfo *ssh_tunnel_info.
 	return nil
 }
 
+func (c *NvrhInternalSshClient) RunStdio(command string) (io.ReadWriteCloser, error) {
+	if c.SshClient == nil {
+		return nil, fmt.Errorf("ssh client not initialized")
+	}
+
+	slog.Debug("Running command via SSH with stdio", "command", command)
+
+	session, err := c.newSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if c.Ctx.Debug {
+		session.Stderr = os.Stderr
+	}
+
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &sessionStream{session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+func (c *NvrhInternalSshClient) OpenSftp() (io.ReadWriteCloser, error) {
+	if c.SshClient == nil {
+		return nil, fmt.Errorf("ssh client not initialized")
+	}
+
+	slog.Debug("Starting SFTP via SSH")
+
+	session, err := c.SshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &sessionStream{session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+func (c *NvrhInternalSshClient) newSession() (*ssh.Session, error) {
+	session, err := c.SshClient.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Agent != nil {
+		c.forwardAgentOnce.Do(func() {
+			if err := agent.ForwardToAgent(c.SshClient, c.Agent); err != nil {
+				slog.Error("Failed to set up agent forwarding", "err", err)
+			}
+		})
+
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			slog.Warn("Failed to request agent forwarding", "err", err)
+		}
+	}
+
+	return session, nil
+}
+
+type sessionStream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+func (s *sessionStream) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+func (s *sessionStream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+// CloseWrite closes stdin, so the command sees the end of its input.
+func (s *sessionStream) CloseWrite() error {
+	return s.stdin.Close()
+}
+
+func (s *sessionStream) Close() error {
+	s.stdin.Close()
+	return s.session.Close()
+}
+
 func (c *NvrhInternalSshClient) TunnelSocket(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) {
 	if c.SshClient == nil {
 		return
@@ -97,12 +217,13 @@ func (c *NvrhInternalSshClient) TunnelSocket(tunnelInfo *ssh_tunnel_info.SshTunn
 		}
 
 		// Start a goroutine to handle the connection
-		go handleConnection(localConn, remoteConn)
+		go HandleConnection(localConn, remoteConn)
 	}
 
 }
 
-func handleConnection(localConn net.Conn, remoteConn net.Conn) {
+// HandleConnection copies between a tunnel's two ends until either closes.
+func HandleConnection(localConn net.Conn, remoteConn net.Conn) {
 	// Close connections when done
 	defer localConn.Close()
 	defer remoteConn.Close()
@@ -0,0 +1,73 @@
+package nvrh_k8s_ssh
+
+import (
+	"net"
+
+	"nvrh/src/context"
+	"nvrh/src/nvrh_local_ssh"
+	"nvrh/src/ssh_tunnel_info"
+)
+
+// NvrhK8sSshClient runs nvim in a pod with `kubectl exec`. Sockets and ports
+// are relayed over the stdio of another `kubectl exec`, which, unlike
+// `kubectl port-forward`, also works for unix sockets.
+type NvrhK8sSshClient struct {
+	nvrh_local_ssh.NvrhLocalSshClient
+
+	KubectlPath string
+	Context     string
+	Namespace   string
+	Pod         string
+	Container   string
+}
+
+func NewNvrhK8sSshClient(
+	ctx *context.NvrhContext,
+	kubectlPath string,
+	kubeContext string,
+	namespace string,
+	pod string,
+	container string,
+) *NvrhK8sSshClient {
+	c := &NvrhK8sSshClient{
+		KubectlPath: kubectlPath,
+		Context:     kubeContext,
+		Namespace:   namespace,
+		Pod:         pod,
+		Container:   container,
+	}
+
+	c.Ctx = ctx
+	c.WrapCommand = c.wrapCommand
+	c.DialRemote = c.dialRemote
+
+	return c
+}
+
+func (c *NvrhK8sSshClient) execArgs() []string {
+	args := []string{c.KubectlPath}
+	if c.Context != "" {
+		args = append(args, "--context", c.Context)
+	}
+
+	// Keep stdin open for relays and RunStdio.
+	args = append(args, "exec", "-i", "-n", c.Namespace)
+
+	args = append(args, c.Pod)
+	if c.Container != "" {
+		args = append(args, "-c", c.Container)
+	}
+
+	return append(args, "--")
+}
+
+func (c *NvrhK8sSshClient) wrapCommand(command string) []string {
+	return nvrh_local_ssh.ExecShellCommand(c.execArgs(), command)
+}
+
+func (c *NvrhK8sSshClient) dialRemote(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) (net.Conn, error) {
+	return nvrh_local_ssh.DialCommand(append(
+		c.execArgs(),
+		nvrh_local_ssh.RelayCommand(c.Ctx.NvimCmd, tunnelInfo)...,
+	))
+}
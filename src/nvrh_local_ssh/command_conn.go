@@ -0,0 +1,125 @@
+package nvrh_local_ssh
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"nvrh/src/bridge_files"
+	"nvrh/src/exec_helpers"
+	"nvrh/src/ssh_tunnel_info"
+)
+
+// ExecShellCommand returns the arguments to run command in a shell through
+// an exec tool like `docker exec`. Those don't go through a login, so $SHELL
+// is often unset, which the remote command relies on.
+func ExecShellCommand(execArgs []string, command string) []string {
+	return append(
+		execArgs,
+		"sh", "-c", `[ -n "$SHELL" ] || SHELL=/bin/sh; export SHELL; `+command,
+	)
+}
+
+// RelayCommand returns the arguments to run a headless nvim that relays its
+// stdin / stdout to the remote side of a tunnel. nvim is the one thing we
+// know exists on the remote, so it doubles as a portable `socat`.
+func RelayCommand(nvimCmd []string, tunnelInfo *ssh_tunnel_info.SshTunnelInfo) []string {
+	address := tunnelInfo.RemoteSocket
+	if tunnelInfo.Mode == "port" {
+		address = fmt.Sprintf("localhost:%s", tunnelInfo.RemoteSocket)
+	}
+
+	script := base64.StdEncoding.EncodeToString([]byte(bridge_files.ReadFileWithoutError("lua/stdio_relay.lua")))
+	encodedAddress := base64.StdEncoding.EncodeToString([]byte(address))
+
+	args := append([]string{}, nvimCmd...)
+	return append(
+		args,
+		"--headless", "-u", "NONE", "-i", "NONE", "-n",
+		"--cmd", fmt.Sprintf(
+			`lua loadstring(vim.base64.decode("%s"))(vim.base64.decode("%s"))`,
+			script,
+			encodedAddress,
+		),
+	)
+}
+
+// DialCommand starts a command and returns a connection over its stdin and
+// stdout. Closing the connection kills the command.
+func DialCommand(args []string) (net.Conn, error) {
+	slog.Debug("Dialing through command", "command", args)
+
+	command := exec.Command(args[0], args[1:]...)
+	exec_helpers.PrepareForForking(command)
+
+	stdin, err := command.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+
+	return &commandConn{command: command, stdin: stdin, stdout: stdout}, nil
+}
+
+type commandConn struct {
+	command *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+
+	closeOnce sync.Once
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite closes stdin, so the command sees the end of its input.
+func (c *commandConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		exec_helpers.Kill(c.command)
+		c.command.Wait()
+	})
+
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return commandAddr{}
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return commandAddr{}
+}
+
+// Deadlines aren't supported, nothing in nvrh sets them on tunneled
+// connections.
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "command" }
+func (commandAddr) String() string  { return "command" }
@@ -0,0 +1,172 @@
+package nvrh_local_ssh
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"nvrh/src/context"
+	"nvrh/src/exec_helpers"
+	"nvrh/src/nvrh_internal_ssh"
+	"nvrh/src/ssh_tunnel_info"
+)
+
+// NvrhLocalSshClient runs the "remote" side on this machine. It doesn't need
+// a network, which makes it useful for containers and testing.
+//
+// Other transports can reuse it by setting WrapCommand to change how commands
+// are started, and DialRemote to change how remote sockets are reached.
+type NvrhLocalSshClient struct {
+	Ctx *context.NvrhContext
+
+	// WrapCommand turns a shell command into the arguments to execute.
+	// Defaults to running it with the local shell.
+	WrapCommand func(command string) []string
+
+	// DialRemote connects to the remote side of a tunnel. Defaults to dialing
+	// it directly.
+	DialRemote func(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) (net.Conn, error)
+
+	initOnce  sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *NvrhLocalSshClient) init() {
+	c.initOnce.Do(func() {
+		c.closed = make(chan struct{})
+	})
+}
+
+func (c *NvrhLocalSshClient) Close() error {
+	c.init()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+func (c *NvrhLocalSshClient) Run(command string, tunnelInfo *ssh_tunnel_info.SshTunnelInfo) error {
+	c.init()
+
+	if tunnelInfo != nil && tunnelInfo.DirectConnectHost == "" {
+		go c.TunnelSocket(tunnelInfo)
+	}
+
+	args := c.commandArgs(command)
+
+	slog.Debug("Running command locally", "command", args)
+
+	localCommand := exec.Command(args[0], args[1:]...)
+	exec_helpers.PrepareForForking(localCommand)
+
+	c.Ctx.CommandsToKill = append(c.Ctx.CommandsToKill, localCommand)
+	if c.Ctx.Debug {
+		localCommand.Stdout = os.Stdout
+		localCommand.Stderr = os.Stderr
+	}
+
+	if err := localCommand.Start(); err != nil {
+		return err
+	}
+
+	if err := localCommand.Wait(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *NvrhLocalSshClient) RunStdio(command string) (io.ReadWriteCloser, error) {
+	return DialCommand(c.commandArgs(command))
+}
+
+func (c *NvrhLocalSshClient) TunnelSocket(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) {
+	c.init()
+
+	// When both sides are the same address on the same machine, there is
+	// nothing to tunnel.
+	if c.DialRemote == nil && tunnelInfo.LocalSocket == tunnelInfo.RemoteSocket {
+		slog.Debug("Local and remote socket are the same, not tunneling", "tunnelInfo", tunnelInfo)
+		<-c.closed
+		return
+	}
+
+	localListener, err := nvrh_internal_ssh.LocalListenerFromTunnelInfo(tunnelInfo)
+	if err != nil {
+		slog.Error("Failed to listen on local socket", "err", err)
+		return
+	}
+
+	defer localListener.Close()
+
+	// Clean up local socket file
+	defer func() {
+		if tunnelInfo.Mode == "unix" {
+			os.Remove(tunnelInfo.LocalSocket)
+		}
+	}()
+
+	go func() {
+		<-c.closed
+		localListener.Close()
+	}()
+
+	slog.Info("Tunneling socket", "tunnelInfo", tunnelInfo)
+
+	for {
+		localConn, err := localListener.Accept()
+		if err != nil {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+
+			slog.Error("Failed to accept connection", "err", err)
+			continue
+		}
+
+		remoteConn, err := c.dialRemote(tunnelInfo)
+		if err != nil {
+			slog.Error("Failed to dial remote socket", "err", err)
+			localConn.Close()
+			continue
+		}
+
+		go nvrh_internal_ssh.HandleConnection(localConn, remoteConn)
+	}
+}
+
+func (c *NvrhLocalSshClient) commandArgs(command string) []string {
+	if c.WrapCommand != nil {
+		return c.WrapCommand(command)
+	}
+
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/c", command}
+	}
+
+	return []string{"sh", "-c", command}
+}
+
+func (c *NvrhLocalSshClient) dialRemote(tunnelInfo *ssh_tunnel_info.SshTunnelInfo) (net.Conn, error) {
+	if c.DialRemote != nil {
+		return c.DialRemote(tunnelInfo)
+	}
+
+	switch tunnelInfo.Mode {
+	case "unix":
+		return net.Dial("unix", tunnelInfo.RemoteSocket)
+	case "port":
+		return net.Dial("tcp", fmt.Sprintf("localhost:%s", tunnelInfo.RemoteSocket))
+	}
+
+	return nil, fmt.Errorf("Invalid mode: %s", tunnelInfo.Mode)
+}
@@ -0,0 +1,259 @@
+package rpc_mux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Mux shares a single msgpack-rpc stream to nvim, like the stdio of
+// `nvim --embed`, between several local connections.
+//
+// The first connection is nvrh itself: it gets every request and
+// notification nvim sends, except UI events which go to the connections that
+// attached a UI. Requests from every connection are given new msgids so the
+// responses can be routed back.
+type Mux struct {
+	upstream   io.ReadWriteCloser
+	upstreamMu sync.Mutex
+
+	mu        sync.Mutex
+	clients   map[*client]bool
+	primary   *client
+	nextMsgId uint64
+	pending   map[uint64]pendingRequest
+}
+
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	uiAttached bool
+}
+
+type pendingRequest struct {
+	client *client
+	msgId  uint64
+}
+
+func New(upstream io.ReadWriteCloser) *Mux {
+	return &Mux{
+		upstream: upstream,
+		clients:  map[*client]bool{},
+		pending:  map[uint64]pendingRequest{},
+	}
+}
+
+// Serve accepts connections on listener until the upstream stream ends.
+func (m *Mux) Serve(listener net.Listener) error {
+	defer listener.Close()
+	defer m.closeClients()
+
+	go m.accept(listener)
+
+	reader := bufio.NewReader(m.upstream)
+	for {
+		msg, err := readMessage(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		m.routeFromNvim(msg)
+	}
+}
+
+func (m *Mux) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &client{conn: conn}
+
+		m.mu.Lock()
+		m.clients[c] = true
+		if m.primary == nil {
+			m.primary = c
+		}
+		isPrimary := m.primary == c
+		m.mu.Unlock()
+
+		slog.Debug("Multiplexed connection opened", "remote", conn.RemoteAddr(), "primary", isPrimary)
+
+		go m.serveClient(c)
+	}
+}
+
+func (m *Mux) serveClient(c *client) {
+	defer m.removeClient(c)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		msg, err := readMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Multiplexed connection failed", "err", err)
+			}
+
+			return
+		}
+
+		m.routeFromClient(c, msg)
+	}
+}
+
+func (m *Mux) routeFromClient(c *client, msg *message) {
+	m.mu.Lock()
+	isPrimary := m.primary == c
+
+	switch msg.method {
+	case "nvim_set_client_info":
+		// There is only one channel, and it belongs to nvrh.
+		if !isPrimary {
+			m.mu.Unlock()
+
+			if msg.kind == kindRequest {
+				c.write(encodeResponse(msg.msgId, ""))
+			}
+
+			return
+		}
+
+	case "nvim_ui_attach":
+		c.uiAttached = true
+
+	case "nvim_ui_detach":
+		c.uiAttached = false
+	}
+
+	if msg.kind != kindRequest {
+		m.mu.Unlock()
+		m.writeUpstream(msg.raw)
+		return
+	}
+
+	msgId := m.allocateMsgId(c, msg.msgId)
+	m.mu.Unlock()
+
+	m.writeUpstream(msg.withMsgId(msgId))
+}
+
+func (m *Mux) routeFromNvim(msg *message) {
+	// Writes to clients can block, so only pick the recipients under the
+	// lock.
+	recipients, payload := m.recipientsFromNvim(msg)
+	for _, c := range recipients {
+		c.write(payload)
+	}
+}
+
+func (m *Mux) recipientsFromNvim(msg *message) ([]*client, []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if msg.kind == kindResponse {
+		request, ok := m.pending[msg.msgId]
+		if !ok {
+			return nil, nil
+		}
+		delete(m.pending, msg.msgId)
+
+		if request.client != nil && m.clients[request.client] {
+			return []*client{request.client}, msg.withMsgId(request.msgId)
+		}
+
+		return nil, nil
+	}
+
+	switch msg.method {
+	case "redraw":
+		var recipients []*client
+		for c := range m.clients {
+			if c.uiAttached {
+				recipients = append(recipients, c)
+			}
+		}
+
+		return recipients, msg.raw
+
+	case "nvim_error_event":
+		var recipients []*client
+		for c := range m.clients {
+			recipients = append(recipients, c)
+		}
+
+		return recipients, msg.raw
+	}
+
+	if m.primary != nil {
+		return []*client{m.primary}, msg.raw
+	} else if msg.kind == kindRequest {
+		go m.writeUpstream(encodeResponse(msg.msgId, "nvrh is not connected"))
+	}
+
+	return nil, nil
+}
+
+func (m *Mux) removeClient(c *client) {
+	c.conn.Close()
+
+	m.mu.Lock()
+	delete(m.clients, c)
+	if m.primary == c {
+		m.primary = nil
+	}
+
+	// Leaving the UI attached would keep nvim waiting for a UI that is gone.
+	var detach []byte
+	if c.uiAttached {
+		detach = encodeRequest(m.allocateMsgId(nil, 0), "nvim_ui_detach")
+	}
+	m.mu.Unlock()
+
+	if detach != nil {
+		m.writeUpstream(detach)
+	}
+
+	slog.Debug("Multiplexed connection closed", "remote", c.conn.RemoteAddr())
+}
+
+func (m *Mux) closeClients() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for c := range m.clients {
+		c.conn.Close()
+	}
+}
+
+// allocateMsgId must be called with mu held.
+func (m *Mux) allocateMsgId(c *client, msgId uint64) uint64 {
+	m.nextMsgId = (m.nextMsgId + 1) & 0xffffffff
+	m.pending[m.nextMsgId] = pendingRequest{client: c, msgId: msgId}
+
+	return m.nextMsgId
+}
+
+func (m *Mux) writeUpstream(b []byte) {
+	m.upstreamMu.Lock()
+	defer m.upstreamMu.Unlock()
+
+	if _, err := m.upstream.Write(b); err != nil {
+		slog.Warn("Failed to write to nvim", "err", err)
+	}
+}
+
+func (c *client) write(b []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.Write(b)
+}
@@ -0,0 +1,313 @@
+package rpc_mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	kindRequest      = 0
+	kindResponse     = 1
+	kindNotification = 2
+)
+
+// message is a msgpack-rpc message kept in its encoded form, so it can be
+// passed along without understanding the params or results.
+type message struct {
+	raw []byte
+
+	kind   int
+	msgId  uint64
+	method string
+
+	// Where the msgid starts and ends in raw, for rewriting it.
+	idStart int
+	idEnd   int
+}
+
+// withMsgId returns the encoded message with its msgid replaced.
+func (m *message) withMsgId(msgId uint64) []byte {
+	out := make([]byte, 0, len(m.raw)+8)
+	out = append(out, m.raw[:m.idStart]...)
+	out = appendUint(out, msgId)
+	return append(out, m.raw[m.idEnd:]...)
+}
+
+func readMessage(r *bufio.Reader) (*message, error) {
+	var buf bytes.Buffer
+	if err := readObject(r, &buf); err != nil {
+		return nil, err
+	}
+
+	m := &message{raw: buf.Bytes()}
+	b := m.raw
+
+	length, pos, err := readArrayLen(b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, pos, err := readUint(b, pos)
+	if err != nil {
+		return nil, err
+	}
+	m.kind = int(kind)
+
+	switch m.kind {
+	case kindRequest, kindResponse:
+		if length != 4 {
+			return nil, fmt.Errorf("malformed rpc message of kind %d with %d elements", kind, length)
+		}
+
+		m.idStart = pos
+		m.msgId, pos, err = readUint(b, pos)
+		if err != nil {
+			return nil, err
+		}
+		m.idEnd = pos
+
+		if m.kind == kindRequest {
+			m.method, _, err = readString(b, pos)
+		}
+
+	case kindNotification:
+		if length != 3 {
+			return nil, fmt.Errorf("malformed rpc notification with %d elements", length)
+		}
+
+		m.method, _, err = readString(b, pos)
+
+	default:
+		return nil, fmt.Errorf("unknown rpc message kind %d", kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// readObject copies one msgpack object from r into out.
+func readObject(r *bufio.Reader, out *bytes.Buffer) error {
+	readN := func(n int) (uint64, error) {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return 0, err
+		}
+		out.Write(data)
+
+		var v uint64
+		for _, d := range data {
+			v = v<<8 | uint64(d)
+		}
+
+		return v, nil
+	}
+
+	for pending := 1; pending > 0; pending-- {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		out.WriteByte(b)
+
+		var size, children uint64
+
+		switch {
+		case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+			// fixint, nil, false, true
+		case b >= 0x80 && b <= 0x8f:
+			children = 2 * uint64(b&0x0f)
+		case b >= 0x90 && b <= 0x9f:
+			children = uint64(b & 0x0f)
+		case b >= 0xa0 && b <= 0xbf:
+			size = uint64(b & 0x1f)
+		case b == 0xc4, b == 0xd9:
+			size, err = readN(1)
+		case b == 0xc5, b == 0xda:
+			size, err = readN(2)
+		case b == 0xc6, b == 0xdb:
+			size, err = readN(4)
+		case b == 0xc7:
+			size, err = readN(1)
+			size++
+		case b == 0xc8:
+			size, err = readN(2)
+			size++
+		case b == 0xc9:
+			size, err = readN(4)
+			size++
+		case b == 0xcc, b == 0xd0:
+			size = 1
+		case b == 0xcd, b == 0xd1:
+			size = 2
+		case b == 0xca, b == 0xce, b == 0xd2:
+			size = 4
+		case b == 0xcb, b == 0xcf, b == 0xd3:
+			size = 8
+		case b >= 0xd4 && b <= 0xd8:
+			// fixext 1, 2, 4, 8, 16 plus the type byte.
+			size = 1<<(b-0xd4) + 1
+		case b == 0xdc:
+			children, err = readN(2)
+		case b == 0xdd:
+			children, err = readN(4)
+		case b == 0xde:
+			children, err = readN(2)
+			children *= 2
+		case b == 0xdf:
+			children, err = readN(4)
+			children *= 2
+		default:
+			return fmt.Errorf("invalid msgpack byte 0x%02x", b)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if size > 0 {
+			if _, err := io.CopyN(out, r, int64(size)); err != nil {
+				return err
+			}
+		}
+
+		pending += int(children)
+	}
+
+	return nil
+}
+
+func readArrayLen(b []byte, pos int) (int, int, error) {
+	if pos >= len(b) {
+		return 0, pos, io.ErrUnexpectedEOF
+	}
+
+	switch c := b[pos]; {
+	case c >= 0x90 && c <= 0x9f:
+		return int(c & 0x0f), pos + 1, nil
+	case c == 0xdc && pos+3 <= len(b):
+		return int(binary.BigEndian.Uint16(b[pos+1:])), pos + 3, nil
+	case c == 0xdd && pos+5 <= len(b):
+		return int(binary.BigEndian.Uint32(b[pos+1:])), pos + 5, nil
+	}
+
+	return 0, pos, fmt.Errorf("expected msgpack array")
+}
+
+func readUint(b []byte, pos int) (uint64, int, error) {
+	if pos >= len(b) {
+		return 0, pos, io.ErrUnexpectedEOF
+	}
+
+	c := b[pos]
+	if c <= 0x7f {
+		return uint64(c), pos + 1, nil
+	}
+
+	var size int
+	switch c {
+	case 0xcc:
+		size = 1
+	case 0xcd:
+		size = 2
+	case 0xce:
+		size = 4
+	case 0xcf:
+		size = 8
+	default:
+		return 0, pos, fmt.Errorf("expected msgpack unsigned int")
+	}
+
+	if pos+1+size > len(b) {
+		return 0, pos, io.ErrUnexpectedEOF
+	}
+
+	var v uint64
+	for _, d := range b[pos+1 : pos+1+size] {
+		v = v<<8 | uint64(d)
+	}
+
+	return v, pos + 1 + size, nil
+}
+
+func readString(b []byte, pos int) (string, int, error) {
+	if pos >= len(b) {
+		return "", pos, io.ErrUnexpectedEOF
+	}
+
+	var size, start int
+	switch c := b[pos]; {
+	case c >= 0xa0 && c <= 0xbf:
+		size, start = int(c&0x1f), pos+1
+	case (c == 0xd9 || c == 0xc4) && pos+2 <= len(b):
+		size, start = int(b[pos+1]), pos+2
+	case (c == 0xda || c == 0xc5) && pos+3 <= len(b):
+		size, start = int(binary.BigEndian.Uint16(b[pos+1:])), pos+3
+	case (c == 0xdb || c == 0xc6) && pos+5 <= len(b):
+		size, start = int(binary.BigEndian.Uint32(b[pos+1:])), pos+5
+	default:
+		return "", pos, fmt.Errorf("expected msgpack string")
+	}
+
+	if start+size > len(b) {
+		return "", pos, io.ErrUnexpectedEOF
+	}
+
+	return string(b[start : start+size]), start + size, nil
+}
+
+func appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(b, byte(v))
+	case v <= 0xff:
+		return append(b, 0xcc, byte(v))
+	case v <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	}
+
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+}
+
+func appendString(b []byte, s string) []byte {
+	switch {
+	case len(s) <= 31:
+		b = append(b, 0xa0|byte(len(s)))
+	case len(s) <= 0xff:
+		b = append(b, 0xd9, byte(len(s)))
+	case len(s) <= 0xffff:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(len(s)))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(len(s)))
+	}
+
+	return append(b, s...)
+}
+
+// encodeResponse encodes a response with a nil result, or with errorMessage
+// as the error when it isn't empty.
+func encodeResponse(msgId uint64, errorMessage string) []byte {
+	b := appendUint([]byte{0x94, kindResponse}, msgId)
+
+	if errorMessage != "" {
+		b = appendString(b, errorMessage)
+	} else {
+		b = append(b, 0xc0)
+	}
+
+	return append(b, 0xc0)
+}
+
+// encodeRequest encodes a request without params.
+func encodeRequest(msgId uint64, method string) []byte {
+	b := appendUint([]byte{0x94, kindRequest}, msgId)
+	b = appendString(b, method)
+	return append(b, 0x90)
+}
@@ -0,0 +1,252 @@
+package rpc_mux
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func repeat(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var objectTests = []struct {
+	name string
+	data []byte
+}{
+	{"positive fixint", []byte{0x7f}},
+	{"negative fixint", []byte{0xe0}},
+	{"nil", []byte{0xc0}},
+	{"false", []byte{0xc2}},
+	{"true", []byte{0xc3}},
+	{"fixmap", []byte{0x81, 0xa1, 'k', 0x01}},
+	{"empty fixmap", []byte{0x80}},
+	{"fixarray", []byte{0x92, 0x01, 0xa1, 'x'}},
+	{"fixstr", []byte{0xa3, 'a', 'b', 'c'}},
+	{"bin8", []byte{0xc4, 0x02, 0x00, 0x01}},
+	{"bin16", concat([]byte{0xc5, 0x01, 0x00}, repeat(0x01, 256))},
+	{"bin32", []byte{0xc6, 0x00, 0x00, 0x00, 0x01, 0xff}},
+	{"ext8", []byte{0xc7, 0x02, 0x01, 0xaa, 0xbb}},
+	{"ext16", concat([]byte{0xc8, 0x01, 0x00, 0x01}, repeat(0xaa, 256))},
+	{"ext32", []byte{0xc9, 0x00, 0x00, 0x00, 0x01, 0x01, 0xaa}},
+	{"float32", []byte{0xca, 0x3f, 0x80, 0x00, 0x00}},
+	{"float64", []byte{0xcb, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}},
+	{"uint8", []byte{0xcc, 0xff}},
+	{"uint16", []byte{0xcd, 0xff, 0xff}},
+	{"uint32", []byte{0xce, 0xff, 0xff, 0xff, 0xff}},
+	{"uint64", []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	{"int8", []byte{0xd0, 0x80}},
+	{"int16", []byte{0xd1, 0x80, 0x00}},
+	{"int32", []byte{0xd2, 0x80, 0x00, 0x00, 0x00}},
+	{"int64", []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+	{"fixext1", []byte{0xd4, 0x01, 0xaa}},
+	{"fixext2", []byte{0xd5, 0x01, 0xaa, 0xbb}},
+	{"fixext4", concat([]byte{0xd6, 0x01}, repeat(0xaa, 4))},
+	{"fixext8", concat([]byte{0xd7, 0x01}, repeat(0xaa, 8))},
+	{"fixext16", concat([]byte{0xd8, 0x01}, repeat(0xaa, 16))},
+	{"str8", concat([]byte{0xd9, 0x20}, repeat('s', 32))},
+	{"str16", concat([]byte{0xda, 0x01, 0x00}, repeat('s', 256))},
+	{"str32", []byte{0xdb, 0x00, 0x00, 0x00, 0x02, 'h', 'i'}},
+	{"array16", []byte{0xdc, 0x00, 0x02, 0x01, 0xc0}},
+	{"array32", []byte{0xdd, 0x00, 0x00, 0x00, 0x01, 0xc3}},
+	{"map16", []byte{0xde, 0x00, 0x01, 0xa1, 'k', 0x92, 0x01, 0x02}},
+	{"map32", []byte{0xdf, 0x00, 0x00, 0x00, 0x01, 0x01, 0x81, 0x02, 0x03}},
+	{"nested", []byte{0x91, 0x91, 0x81, 0xa1, 'k', 0xd4, 0x01, 0xaa}},
+}
+
+func TestReadObject(t *testing.T) {
+	// A trailing object makes sure only one is read.
+	trailer := []byte{0xa5, 'a', 'f', 't', 'e', 'r'}
+
+	for _, tt := range objectTests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(concat(tt.data, trailer)))
+
+			var out bytes.Buffer
+			if err := readObject(r, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out.Bytes(), tt.data) {
+				t.Errorf("read % x, want % x", out.Bytes(), tt.data)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, trailer) {
+				t.Errorf("left % x, want % x", rest, trailer)
+			}
+		})
+	}
+}
+
+func TestReadObjectTruncated(t *testing.T) {
+	for _, tt := range objectTests {
+		for n := 0; n < len(tt.data); n++ {
+			r := bufio.NewReader(bytes.NewReader(tt.data[:n]))
+
+			var out bytes.Buffer
+			err := readObject(r, &out)
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s cut to %d bytes: err = %v, want EOF", tt.name, n, err)
+			}
+		}
+	}
+}
+
+func TestReadObjectInvalid(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{0xc1}))
+
+	var out bytes.Buffer
+	if err := readObject(r, &out); err == nil || !strings.Contains(err.Error(), "0xc1") {
+		t.Errorf("err = %v, want invalid msgpack byte 0xc1", err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantKind   int
+		wantMsgId  uint64
+		wantMethod string
+	}{
+		{
+			"request",
+			[]byte{0x94, 0x00, 0x05, 0xa4, 'p', 'i', 'n', 'g', 0x91, 0x01},
+			kindRequest, 5, "ping",
+		},
+		{
+			"request with str8 method",
+			concat([]byte{0x94, 0x00, 0xcd, 0x01, 0x00, 0xd9, 0x20}, repeat('m', 32), []byte{0x90}),
+			kindRequest, 256, strings.Repeat("m", 32),
+		},
+		{
+			"response",
+			[]byte{0x94, 0x01, 0xce, 0x00, 0x01, 0x00, 0x00, 0xc0, 0x81, 0x01, 0x02},
+			kindResponse, 65536, "",
+		},
+		{
+			"notification",
+			[]byte{0x93, 0x02, 0xa3, 'e', 'v', 't', 0x90},
+			kindNotification, 0, "evt",
+		},
+		{
+			"array16 request",
+			[]byte{0xdc, 0x00, 0x04, 0x00, 0x07, 0xa1, 'm', 0x90},
+			kindRequest, 7, "m",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readMessage(bufio.NewReader(bytes.NewReader(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.kind != tt.wantKind || m.msgId != tt.wantMsgId || m.method != tt.wantMethod {
+				t.Errorf("got kind %d, msgid %d, method %q, want %d, %d, %q", m.kind, m.msgId, m.method, tt.wantKind, tt.wantMsgId, tt.wantMethod)
+			}
+
+			if !bytes.Equal(m.raw, tt.data) {
+				t.Errorf("raw = % x, want % x", m.raw, tt.data)
+			}
+		})
+	}
+}
+
+func TestReadMessageMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not an array", []byte{0xa1, 'x'}},
+		{"unknown kind", []byte{0x93, 0x03, 0xa1, 'm', 0x90}},
+		{"request with 3 elements", []byte{0x93, 0x00, 0x01, 0xa1, 'm'}},
+		{"notification with 4 elements", []byte{0x94, 0x02, 0xa1, 'm', 0x90, 0xc0}},
+		{"signed msgid", []byte{0x94, 0x00, 0xd0, 0x01, 0xa1, 'm', 0x90}},
+		{"method not a string", []byte{0x94, 0x00, 0x01, 0x01, 0x90}},
+		{"truncated", []byte{0x94, 0x00, 0x01, 0xa4, 'p', 'i'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readMessage(bufio.NewReader(bytes.NewReader(tt.data))); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestWithMsgId(t *testing.T) {
+	request := []byte{0x94, 0x00, 0xcd, 0x01, 0x00, 0xa1, 'm', 0x91, 0x01}
+
+	tests := []struct {
+		msgId uint64
+		want  []byte
+	}{
+		{0, []byte{0x94, 0x00, 0x00, 0xa1, 'm', 0x91, 0x01}},
+		{0x7f, []byte{0x94, 0x00, 0x7f, 0xa1, 'm', 0x91, 0x01}},
+		{0xff, []byte{0x94, 0x00, 0xcc, 0xff, 0xa1, 'm', 0x91, 0x01}},
+		{0x100, []byte{0x94, 0x00, 0xcd, 0x01, 0x00, 0xa1, 'm', 0x91, 0x01}},
+		{0x10000, []byte{0x94, 0x00, 0xce, 0x00, 0x01, 0x00, 0x00, 0xa1, 'm', 0x91, 0x01}},
+		{1 << 32, []byte{0x94, 0x00, 0xcf, 0, 0, 0, 0x01, 0, 0, 0, 0, 0xa1, 'm', 0x91, 0x01}},
+	}
+
+	m, err := readMessage(bufio.NewReader(bytes.NewReader(request)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		got := m.withMsgId(tt.msgId)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("withMsgId(%d) = % x, want % x", tt.msgId, got, tt.want)
+		}
+
+		rewritten, err := readMessage(bufio.NewReader(bytes.NewReader(got)))
+		if err != nil {
+			t.Fatalf("withMsgId(%d): %v", tt.msgId, err)
+		}
+		if rewritten.msgId != tt.msgId || rewritten.method != "m" {
+			t.Errorf("withMsgId(%d) reads back as msgid %d, method %q", tt.msgId, rewritten.msgId, rewritten.method)
+		}
+	}
+
+	// The original is left alone.
+	if !bytes.Equal(m.raw, request) {
+		t.Errorf("raw changed to % x", m.raw)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want *message
+	}{
+		{"request", encodeRequest(300, "nvrh_ping"), &message{kind: kindRequest, msgId: 300, method: "nvrh_ping"}},
+		{"response", encodeResponse(9, ""), &message{kind: kindResponse, msgId: 9}},
+		{"error response", encodeResponse(9, strings.Repeat("e", 40)), &message{kind: kindResponse, msgId: 9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readMessage(bufio.NewReader(bytes.NewReader(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.kind != tt.want.kind || m.msgId != tt.want.msgId || m.method != tt.want.method {
+				t.Errorf("got kind %d, msgid %d, method %q", m.kind, m.msgId, m.method)
+			}
+		})
+	}
+}
@@ -1,19 +1,44 @@
 package ssh_endpoint
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/url"
+	"os/exec"
 	"os/user"
 	"runtime"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/kevinburke/ssh_config"
 )
 
+const (
+	SourceGiven     = "given"
+	SourceSshG      = "ssh -G"
+	SourceSshConfig = "ssh_config"
+	SourceDefault   = "default"
+)
+
+const (
+	SchemeSsh    = "ssh"
+	SchemeDocker = "docker"
+	SchemeK8s    = "k8s"
+)
+
 type SshEndpoint struct {
 	Given string
 
+	// Scheme is the transport the server was given for, SchemeSsh unless it
+	// was written like `docker://container`.
+	Scheme string
+
+	// Only set for SchemeK8s, where GivenHost is the pod.
+	Namespace string
+	Container string
+
 	GivenUser     string
 	SshConfigUser string
 	FallbackUser  string
@@ -23,9 +48,19 @@ type SshEndpoint struct {
 
 	GivenPort     string
 	SshConfigPort string
+
+	// SshConfigSource is where the SshConfig* values and SshConfigGet results
+	// came from, either SourceSshG or SourceSshConfig.
+	SshConfigSource string
+	// Values reported by `ssh -G`, keyed by lowercase option name.
+	resolvedOptions map[string][]string
 }
 
 func (e *SshEndpoint) String() string {
+	if e.Scheme != SchemeSsh {
+		return e.Given
+	}
+
 	portPart := ""
 	if e.FinalPort() != "22" {
 		portPart = fmt.Sprintf(":%s", e.FinalPort())
@@ -34,6 +69,97 @@ func (e *SshEndpoint) String() string {
 	return fmt.Sprintf("%s@%s%s", e.FinalUser(), e.FinalHost(), portPart)
 }
 
+// UserSource returns where FinalUser came from.
+func (e *SshEndpoint) UserSource() string {
+	if e.GivenUser != "" {
+		return SourceGiven
+	}
+
+	if e.SshConfigUser != "" {
+		return e.SshConfigSource
+	}
+
+	return SourceDefault
+}
+
+// HostSource returns where FinalHost came from.
+func (e *SshEndpoint) HostSource() string {
+	if e.SshConfigHost != "" {
+		return e.SshConfigSource
+	}
+
+	return SourceGiven
+}
+
+// PortSource returns where FinalPort came from.
+func (e *SshEndpoint) PortSource() string {
+	if e.GivenPort != "" {
+		return SourceGiven
+	}
+
+	if e.SshConfigPort != "" {
+		return e.SshConfigSource
+	}
+
+	return SourceDefault
+}
+
+// ConfigKey returns what server entries in the config file are matched
+// against. Containers keep their scheme, so a pattern written for SSH hosts
+// like `*.prod` doesn't apply to them.
+func (e *SshEndpoint) ConfigKey() string {
+	switch e.Scheme {
+	case SchemeDocker:
+		return fmt.Sprintf("docker://%s", e.GivenHost)
+	case SchemeK8s:
+		return fmt.Sprintf("k8s://%s/%s", e.Namespace, e.GivenHost)
+	default:
+		return e.GivenHost
+	}
+}
+
+// SshConfigGet returns the first value of an ssh_config option for this
+// endpoint, preferring what `ssh -G` reported.
+func (e *SshEndpoint) SshConfigGet(key string) string {
+	if values := e.SshConfigGetAll(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// SshConfigGetAll returns every value of an ssh_config option for this
+// endpoint, preferring what `ssh -G` reported.
+func (e *SshEndpoint) SshConfigGetAll(key string) []string {
+	if e.resolvedOptions != nil {
+		if values, ok := e.resolvedOptions[strings.ToLower(key)]; ok {
+			return values
+		}
+
+		if def := ssh_config.Default(key); def != "" {
+			return []string{def}
+		}
+
+		return nil
+	}
+
+	return ssh_config.GetAll(e.GivenHost, key)
+}
+
+// SshConfigSourceOf returns where SshConfigGet would get a value for key
+// from.
+func (e *SshEndpoint) SshConfigSourceOf(key string) string {
+	if e.resolvedOptions != nil {
+		if _, ok := e.resolvedOptions[strings.ToLower(key)]; ok {
+			return SourceSshG
+		}
+
+		return SourceDefault
+	}
+
+	return SourceSshConfig
+}
+
 func (e *SshEndpoint) FinalUser() string {
 	if e.GivenUser != "" {
 		return e.GivenUser
@@ -66,7 +192,17 @@ func (e *SshEndpoint) FinalPort() string {
 	return "22"
 }
 
+// ParseSshEndpoint parses a server as it was given. For SSH servers,
+// ResolveSshConfig fills in the rest once the --ssh-path to use is known.
 func ParseSshEndpoint(server string) (*SshEndpoint, error) {
+	scheme, rest, hasScheme := strings.Cut(server, "://")
+	if hasScheme && scheme != SchemeSsh {
+		return parseContainerEndpoint(server, scheme, rest)
+	}
+	if hasScheme {
+		server = rest
+	}
+
 	currentUser, err := user.Current()
 
 	if err != nil {
@@ -85,17 +221,194 @@ func ParseSshEndpoint(server string) (*SshEndpoint, error) {
 		fallbackUser = fallbackUser[strings.LastIndex(fallbackUser, `\`)+1:]
 	}
 
-	return &SshEndpoint{
-		Given: server,
+	endpoint := &SshEndpoint{
+		Given:  server,
+		Scheme: SchemeSsh,
 
-		GivenUser:     parsed.User.Username(),
-		SshConfigUser: ssh_config.Get(parsed.Hostname(), "User"),
-		FallbackUser:  fallbackUser,
+		GivenUser:    parsed.User.Username(),
+		FallbackUser: fallbackUser,
+
+		GivenHost: parsed.Hostname(),
+
+		GivenPort: parsed.Port(),
+	}
+
+	return endpoint, nil
+}
+
+// ResolveSshConfig looks up the SshConfig* values for an SSH endpoint, with
+// `ssh -G` when there's an ssh to ask and the ssh_config library otherwise.
+// sshPath is the --ssh-path in use. It does nothing for other transports.
+func (e *SshEndpoint) ResolveSshConfig(sshPath string) {
+	if e.Scheme != SchemeSsh {
+		return
+	}
 
-		GivenHost:     parsed.Hostname(),
-		SshConfigHost: ssh_config.Get(parsed.Hostname(), "HostName"),
+	var user, hostname, port string
+	if resolvedOptions, err := resolveWithSshBinary(e, sshPath); err == nil {
+		e.resolvedOptions = resolvedOptions
+		e.SshConfigSource = SourceSshG
+
+		user, hostname, port = e.SshConfigGet("User"), e.SshConfigGet("HostName"), e.SshConfigGet("Port")
+	} else {
+		slog.Debug("Falling back to ssh_config library", "err", err)
+
+		e.SshConfigSource = SourceSshConfig
+		user = ssh_config.Get(e.GivenHost, "User")
+		hostname = ssh_config.Get(e.GivenHost, "HostName")
+		port = ssh_config.Get(e.GivenHost, "Port")
+	}
+
+	// Both report a host and port even when they're the ones given or the
+	// defaults, and `ssh -G` a user too.
+	if hostname != e.GivenHost {
+		e.SshConfigHost = hostname
+	}
+	if user != e.GivenUser && user != e.FallbackUser {
+		e.SshConfigUser = user
+	}
+	if port != e.GivenPort && port != "22" {
+		e.SshConfigPort = port
+	}
+
+	slog.Debug(
+		"Resolved endpoint",
+		"endpoint", e,
+		"user", e.UserSource(),
+		"host", e.HostSource(),
+		"port", e.PortSource(),
+		"proxyJump", e.SshConfigGet("ProxyJump"),
+		"proxyCommand", e.SshConfigGet("ProxyCommand"),
+	)
+}
+
+// parseContainerEndpoint handles servers that aren't reached over SSH, like
+// `docker://[user@]container` and `k8s://<namespace>/<pod>[/<container>]`.
+// GivenHost is the container or pod, and ConfigKey keeps the scheme when
+// looking up server config.
+func parseContainerEndpoint(server string, scheme string, rest string) (*SshEndpoint, error) {
+	switch scheme {
+	case SchemeDocker:
+	case SchemeK8s:
+		return parseK8sEndpoint(server, rest)
+	default:
+		return nil, fmt.Errorf("unsupported server scheme %q", scheme)
+	}
+
+	user, host, hasUser := strings.Cut(rest, "@")
+	if !hasUser {
+		user, host = "", rest
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("missing container in %q", server)
+	}
+
+	endpoint := &SshEndpoint{
+		Given:  server,
+		Scheme: scheme,
+
+		GivenUser: user,
+		GivenHost: host,
+	}
+
+	slog.Debug("Resolved endpoint", "endpoint", endpoint, "scheme", scheme)
+
+	return endpoint, nil
+}
+
+func parseK8sEndpoint(server string, rest string) (*SshEndpoint, error) {
+	parts := strings.Split(rest, "/")
+	if len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+		return nil, fmt.Errorf("expected k8s://<namespace>/<pod>[/<container>], got %q", server)
+	}
+
+	endpoint := &SshEndpoint{
+		Given:  server,
+		Scheme: SchemeK8s,
+
+		Namespace: parts[0],
+		GivenHost: parts[1],
+	}
+
+	if len(parts) == 3 {
+		endpoint.Container = parts[2]
+	}
+
+	slog.Debug(
+		"Resolved endpoint",
+		"endpoint", endpoint,
+		"namespace", endpoint.Namespace,
+		"pod", endpoint.GivenHost,
+		"container", endpoint.Container,
+	)
+
+	return endpoint, nil
+}
+
+func systemSshPath() (string, error) {
+	if runtime.GOOS == "windows" {
+		if path, err := exec.LookPath(`C:\Windows\System32\OpenSSH\ssh.exe`); err == nil {
+			return path, nil
+		}
+	}
+
+	return exec.LookPath("ssh")
+}
+
+// sshBinaryFor returns the ssh to ask with `ssh -G`: the one given with
+// --ssh-path when it's a path, and the system one otherwise.
+func sshBinaryFor(sshPath string) (string, error) {
+	switch sshPath {
+	case "", "internal", "binary", "local":
+		return systemSshPath()
+	}
+
+	return exec.LookPath(sshPath)
+}
+
+// resolveWithSshBinary asks ssh how it would connect to the endpoint. Unlike
+// the ssh_config library, this handles `Match` blocks and every form of
+// `Include`.
+func resolveWithSshBinary(endpoint *SshEndpoint, givenSshPath string) (map[string][]string, error) {
+	sshPath, err := sshBinaryFor(givenSshPath)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-G"}
+	if endpoint.GivenUser != "" {
+		args = append(args, "-l", endpoint.GivenUser)
+	}
+	if endpoint.GivenPort != "" {
+		args = append(args, "-p", endpoint.GivenPort)
+	}
+	// A host starting with `-` must not be read as an option.
+	args = append(args, "--", endpoint.GivenHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, sshPath, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -G failed: %w", sshPath, err)
+	}
+
+	return parseSshGOutput(string(output)), nil
+}
+
+func parseSshGOutput(output string) map[string][]string {
+	options := map[string][]string{}
+
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if !ok {
+			continue
+		}
+
+		key = strings.ToLower(key)
+		options[key] = append(options[key], strings.TrimSpace(value))
+	}
 
-		GivenPort:     parsed.Port(),
-		SshConfigPort: ssh_config.Get(parsed.Hostname(), "Port"),
-	}, nil
+	return options
 }
@@ -10,6 +10,10 @@ type SshTunnelInfo struct {
 	RemoteSocket      string
 	Public            bool
 	DirectConnectHost string
+
+	// Stdio means the remote nvim talks over the stdio of the command that
+	// started it. Only the local side listens, see rpc_mux.
+	Stdio bool
 }
 
 func (ti *SshTunnelInfo) LocalBoundToIp() string {
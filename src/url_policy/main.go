@@ -0,0 +1,74 @@
+package url_policy
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultSchemes allows web pages, and files from the server through
+// vim.ui.open.
+var DefaultSchemes = []string{"http", "https", "file"}
+
+// Policy decides which URLs the server may open on this machine, including
+// its own files as `file` URLs. Downloads and uploads ask on this machine
+// instead, and the clipboard has a switch of its own.
+type Policy struct {
+	// Schemes that are allowed, like `https` or `mailto`.
+	Schemes []string
+
+	// AllowHosts are glob patterns, like `*.github.com`. When empty, any host
+	// is allowed.
+	AllowHosts []string
+
+	// DenyHosts are glob patterns, and win over AllowHosts.
+	DenyHosts []string
+
+	// Confirm asks before opening anything that passes the other checks.
+	Confirm bool
+}
+
+// Check returns an error saying why a URL isn't allowed, or nil. Host lists
+// only apply to URLs with a host, so `mailto:` only needs its scheme allowed.
+func (p *Policy) Check(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme == "" {
+		return fmt.Errorf("url has no scheme")
+	}
+
+	if !slices.ContainsFunc(p.Schemes, func(s string) bool { return strings.EqualFold(s, scheme) }) {
+		return fmt.Errorf("scheme %s is not allowed", scheme)
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "" {
+		return nil
+	}
+
+	if matchesAny(p.DenyHosts, host) {
+		return fmt.Errorf("host %s is denied", host)
+	}
+
+	if len(p.AllowHosts) > 0 && !matchesAny(p.AllowHosts, host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+
+	return nil
+}
+
+func matchesAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(strings.ToLower(pattern), host); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}